@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"strings"
+)
+
+// requireAdmin wraps a handler so it only sees requests with the admin token, sent as
+// "Authorization: Bearer <token>". Without an admin token, the admin API is switched off.
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			log.WithFields(log.Fields{
+				"area":    "admin",
+				"request": r.URL.Path,
+				"remote":  r.RemoteAddr,
+			}).Warnf("Rejected admin request")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// writeAdminJSON writes an admin API response
+func writeAdminJSON(w http.ResponseWriter, v interface{}, logFields log.Fields) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		log.WithFields(logFields).Errorf("Error writing admin JSON: %s", err)
+	}
+}
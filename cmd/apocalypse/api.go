@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+// handleHistoryAPI serves the history of one series as JSON. Query parameters:
+//
+//	source - forecast source, defaults to the first configured source
+//	model  - model of the source, defaults to the source's default model
+//	metric - "winprob" (default), "winprob/<state>", "ev/<party>", or "popvote/<party>"
+//	window - how far back to look, like "7d" or "all" (default)
+func (s *Server) handleHistoryAPI(w http.ResponseWriter, r *http.Request) {
+	logFields := log.Fields{
+		"request": "/api/history",
+		"query":   r.URL.RawQuery,
+	}
+
+	query := r.URL.Query()
+	source, model := splitSeriesKey(s.defaultSeries()[0])
+	if query.Get("source") != "" {
+		source = query.Get("source")
+		model = ""
+		for _, forecastSource := range s.sources {
+			if forecastSource.Name() == source {
+				model = forecastSource.Models()[0]
+			}
+		}
+	}
+	if query.Get("model") != "" {
+		model = query.Get("model")
+	}
+	metric := query.Get("metric")
+	if metric == "" {
+		metric = metricWinProb
+	}
+	window := query.Get("window")
+	if window == "" {
+		window = "all"
+	}
+	duration, err := parseWindow(window)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	since := time.Time{}
+	if duration > 0 {
+		since = time.Now().Add(-duration)
+	}
+
+	points := s.history.Query(source, model, metric, since)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(points); err != nil {
+		log.WithFields(logFields).Errorf("Error writing history JSON: %s", err)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BackupPolicy says which backups of the data file to keep. The most recent are all kept, then one an
+// hour, then one a day, and anything older is removed.
+type BackupPolicy struct {
+	Recent    int           // how many of the newest backups to keep, however close together they are
+	HourlyFor time.Duration // keep one backup an hour for this long
+	DailyFor  time.Duration // keep one backup a day for this long
+}
+
+// defaultBackupPolicy is used unless configured otherwise
+var defaultBackupPolicy = BackupPolicy{
+	Recent:    20,
+	HourlyFor: 48 * time.Hour,
+	DailyFor:  30 * 24 * time.Hour,
+}
+
+// Backup is a copy of the data file, named <data file>.<unix time>, gzipped with a .gz extension.
+// Older versions didn't compress them.
+type Backup struct {
+	Path       string
+	Time       time.Time
+	Compressed bool
+}
+
+// ID is how a backup is picked on the command line - its unix time
+func (b Backup) ID() string {
+	return strconv.FormatInt(b.Time.Unix(), 10)
+}
+
+// read returns the backup's JSON
+func (b Backup) read() ([]byte, error) {
+	data, err := ioutil.ReadFile(b.Path)
+	if err != nil || !b.Compressed {
+		return data, err
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("Error decompressing %s: %s", b.Path, err)
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// load returns the backup's server state
+func (b Backup) load() (*ServerState, error) {
+	data, err := b.read()
+	if err != nil {
+		return nil, err
+	}
+	serverState := &ServerState{}
+	if err := json.Unmarshal(data, serverState); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %s", b.Path, err)
+	}
+	migrateServerState(serverState)
+	return serverState, nil
+}
+
+// listBackups returns the backups of a data file, newest first
+func listBackups(filePath string) ([]Backup, error) {
+	paths, err := filepath.Glob(filePath + ".*")
+	if err != nil {
+		return nil, fmt.Errorf("Error listing backups: %s", err)
+	}
+
+	backups := []Backup{}
+	for _, path := range paths {
+		suffix := strings.TrimPrefix(path, filePath+".")
+		compressed := strings.HasSuffix(suffix, ".gz")
+		unixTime, err := strconv.ParseInt(strings.TrimSuffix(suffix, ".gz"), 10, 64)
+		if err != nil {
+			// the history file, the outbox, and friends
+			continue
+		}
+		backups = append(backups, Backup{
+			Path:       path,
+			Time:       time.Unix(unixTime, 0),
+			Compressed: compressed,
+		})
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Time.After(backups[j].Time)
+	})
+	return backups, nil
+}
+
+// writeBackup saves a compressed copy of the data file, if there is one
+func writeBackup(filePath string, now time.Time) error {
+	data, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return writeCompressed(backupPath(filePath, now), data)
+}
+
+// backupPath returns where a data file's backup from a point in time goes
+func backupPath(filePath string, backupTime time.Time) string {
+	return fmt.Sprintf("%s.%d.gz", filePath, backupTime.Unix())
+}
+
+// writeCompressed gzips data to a file
+func writeCompressed(filePath string, data []byte) error {
+	compressed := bytes.Buffer{}
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(data); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return writeFileSynced(filePath, compressed.Bytes(), 0644)
+}
+
+// rotateBackups removes the backups the policy doesn't keep
+func rotateBackups(filePath string, policy BackupPolicy, now time.Time) error {
+	backups, err := listBackups(filePath)
+	if err != nil {
+		return err
+	}
+	for _, backup := range expiredBackups(backups, policy, now) {
+		if err := os.Remove(backup.Path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Error removing backup: %s", err)
+		}
+	}
+	return nil
+}
+
+// expiredBackups returns the backups, newest first, that the policy doesn't keep
+func expiredBackups(backups []Backup, policy BackupPolicy, now time.Time) []Backup {
+	expired := []Backup{}
+	hours := make(map[time.Time]bool)
+	days := make(map[time.Time]bool)
+	for i, backup := range backups {
+		hour := backup.Time.Truncate(time.Hour)
+		day := backup.Time.Truncate(24 * time.Hour)
+		age := now.Sub(backup.Time)
+
+		keep := false
+		switch {
+		case i < policy.Recent:
+			keep = true
+		case age < policy.HourlyFor:
+			keep = !hours[hour]
+		case age < policy.DailyFor:
+			keep = !days[day]
+		}
+		if !keep {
+			expired = append(expired, backup)
+			continue
+		}
+		hours[hour] = true
+		days[day] = true
+	}
+	return expired
+}
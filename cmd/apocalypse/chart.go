@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// chart dimensions, in pixels
+const (
+	chartWidth        = 600
+	chartHeight       = 300
+	chartMarginLeft   = 50
+	chartMarginRight  = 20
+	chartMarginTop    = 30
+	chartMarginBottom = 30
+)
+
+// changes at least this big are annotated on charts
+const largeMoveThreshold = 2.0
+
+// most annotations drawn on one chart - the biggest moves win
+const maxAnnotations = 5
+
+var (
+	_chartBackground = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	_chartGrid       = color.RGBA{0xe0, 0xe0, 0xe0, 0xff}
+	_chartMidline    = color.RGBA{0xa0, 0xa0, 0xa0, 0xff}
+	_chartLine       = color.RGBA{0xd6, 0x27, 0x28, 0xff}
+	_chartMarker     = color.RGBA{0x33, 0x33, 0x33, 0xff}
+	_chartText       = color.RGBA{0x33, 0x33, 0x33, 0xff}
+)
+
+// Chart is a line chart of one series of forecast history, as a percentage.
+type Chart struct {
+	Title  string
+	Points []HistoryPoint // sorted, with the first point in effect at Start
+	Start  time.Time
+	End    time.Time
+}
+
+// chartMove is a change in the series worth annotating
+type chartMove struct {
+	time   time.Time
+	value  float32
+	change float32
+}
+
+// largeMoves returns the biggest changes of at least largeMoveThreshold, oldest first
+func (c *Chart) largeMoves() []chartMove {
+	moves := []chartMove{}
+	for i := 1; i < len(c.Points); i++ {
+		change := c.Points[i].Value - c.Points[i-1].Value
+		if math.Abs(float64(change)) >= largeMoveThreshold && !c.Points[i].Time.Before(c.Start) {
+			moves = append(moves, chartMove{time: c.Points[i].Time, value: c.Points[i].Value, change: change})
+		}
+	}
+
+	if len(moves) > maxAnnotations {
+		sort.Slice(moves, func(i, j int) bool { return math.Abs(float64(moves[i].change)) > math.Abs(float64(moves[j].change)) })
+		moves = moves[:maxAnnotations]
+	}
+	sort.Slice(moves, func(i, j int) bool { return moves[i].time.Before(moves[j].time) })
+	return moves
+}
+
+// x coordinate of a time
+func (c *Chart) x(t time.Time) int {
+	plotWidth := chartWidth - chartMarginLeft - chartMarginRight
+	span := c.End.Sub(c.Start)
+	if span <= 0 {
+		return chartMarginLeft
+	}
+	return chartMarginLeft + int(float64(plotWidth)*float64(t.Sub(c.Start))/float64(span))
+}
+
+// y coordinate of a percentage
+func (c *Chart) y(value float32) int {
+	plotHeight := chartHeight - chartMarginTop - chartMarginBottom
+	return chartMarginTop + plotHeight - int(float32(plotHeight)*value/100)
+}
+
+// columns returns the series' value at every x coordinate of the plot
+func (c *Chart) columns() []float32 {
+	return resampleHistory(c.Points, c.Start, c.End, chartWidth-chartMarginLeft-chartMarginRight)
+}
+
+// RenderPNG draws the chart as a PNG, with the same labels and annotations as the SVG, in a small
+// bitmap font
+func (c *Chart) RenderPNG(w io.Writer) error {
+	img := image.NewRGBA(image.Rect(0, 0, chartWidth, chartHeight))
+	draw.Draw(img, img.Bounds(), &image.Uniform{_chartBackground}, image.ZP, draw.Src)
+
+	// the title's drawn double size, if it fits
+	titleScale := 2
+	if chartMarginLeft+textWidth(c.Title, titleScale) > chartWidth-chartMarginRight {
+		titleScale = 1
+	}
+	drawText(img, chartMarginLeft, chartMarginTop-10-chartFontHeight*titleScale, c.Title, titleScale, _chartText)
+
+	for _, value := range []float32{0, 25, 50, 75, 100} {
+		lineColor := _chartGrid
+		if value == 50 {
+			lineColor = _chartMidline
+		}
+		drawLine(img, chartMarginLeft, c.y(value), chartWidth-chartMarginRight, c.y(value), lineColor)
+		label := fmt.Sprintf("%.0f%%", value)
+		drawText(img, chartMarginLeft-5-textWidth(label, 1), c.y(value)-chartFontHeight/2, label, 1, _chartText)
+	}
+	start := c.Start.UTC().Format("Jan 2 15:04")
+	end := c.End.UTC().Format("Jan 2 15:04 MST")
+	drawText(img, chartMarginLeft, chartHeight-10-chartFontHeight, start, 1, _chartText)
+	drawText(img, chartWidth-chartMarginRight-textWidth(end, 1), chartHeight-10-chartFontHeight, end, 1, _chartText)
+
+	if len(c.Points) > 0 {
+		columns := c.columns()
+		for i := 1; i < len(columns); i++ {
+			x := chartMarginLeft + i
+			// two pixels thick
+			drawLine(img, x-1, c.y(columns[i-1]), x, c.y(columns[i]), _chartLine)
+			drawLine(img, x-1, c.y(columns[i-1])-1, x, c.y(columns[i])-1, _chartLine)
+		}
+	}
+
+	for _, move := range c.largeMoves() {
+		fillCircle(img, c.x(move.time), c.y(move.value), 4, _chartMarker)
+
+		// centred above the marker, but kept on the chart
+		label := fmt.Sprintf("%+.1f%%", move.change)
+		labelX := c.x(move.time) - textWidth(label, 1)/2
+		if labelX < 0 {
+			labelX = 0
+		} else if labelX > chartWidth-textWidth(label, 1) {
+			labelX = chartWidth - textWidth(label, 1)
+		}
+		drawText(img, labelX, c.y(move.value)-8-chartFontHeight, label, 1, _chartText)
+	}
+
+	return png.Encode(w, img)
+}
+
+// RenderSVG draws the chart as an SVG, with labels and annotations
+func (c *Chart) RenderSVG(w io.Writer) error {
+	svg := []string{
+		fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="11">`,
+			chartWidth, chartHeight, chartWidth, chartHeight),
+		fmt.Sprintf(`<rect width="%d" height="%d" fill="%s"/>`, chartWidth, chartHeight, svgColor(_chartBackground)),
+		fmt.Sprintf(`<text x="%d" y="%d" font-size="14">%s</text>`, chartMarginLeft, chartMarginTop-10, html.EscapeString(c.Title)),
+	}
+
+	for _, value := range []float32{0, 25, 50, 75, 100} {
+		lineColor := _chartGrid
+		if value == 50 {
+			lineColor = _chartMidline
+		}
+		svg = append(svg,
+			fmt.Sprintf(`<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="%s"/>`,
+				chartMarginLeft, c.y(value), chartWidth-chartMarginRight, c.y(value), svgColor(lineColor)),
+			fmt.Sprintf(`<text x="%d" y="%d" text-anchor="end">%.0f%%</text>`, chartMarginLeft-5, c.y(value)+4, value))
+	}
+	svg = append(svg,
+		fmt.Sprintf(`<text x="%d" y="%d">%s</text>`, chartMarginLeft, chartHeight-10, c.Start.UTC().Format("Jan 2 15:04")),
+		fmt.Sprintf(`<text x="%d" y="%d" text-anchor="end">%s</text>`, chartWidth-chartMarginRight, chartHeight-10, c.End.UTC().Format("Jan 2 15:04 MST")))
+
+	if len(c.Points) > 0 {
+		columns := c.columns()
+		coords := []string{}
+		for i, value := range columns {
+			coords = append(coords, fmt.Sprintf("%d,%d", chartMarginLeft+i, c.y(value)))
+		}
+		svg = append(svg, fmt.Sprintf(`<polyline points="%s" fill="none" stroke="%s" stroke-width="2"/>`,
+			strings.Join(coords, " "), svgColor(_chartLine)))
+	}
+
+	for _, move := range c.largeMoves() {
+		svg = append(svg,
+			fmt.Sprintf(`<circle cx="%d" cy="%d" r="4" fill="%s"/>`, c.x(move.time), c.y(move.value), svgColor(_chartMarker)),
+			fmt.Sprintf(`<text x="%d" y="%d" text-anchor="middle">%+.1f%%</text>`, c.x(move.time), c.y(move.value)-8, move.change))
+	}
+
+	svg = append(svg, "</svg>")
+	_, err := io.WriteString(w, strings.Join(svg, "\n"))
+	return err
+}
+
+// svgColor formats a color for SVG
+func svgColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// drawLine draws a line with Bresenham's algorithm
+func drawLine(img *image.RGBA, x0 int, y0 int, x1 int, y1 int, c color.Color) {
+	dx := abs(x1 - x0)
+	dy := -abs(y1 - y0)
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+	err := dx + dy
+	for {
+		img.Set(x0, y0, c)
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		e2 := 2 * err
+		if e2 >= dy {
+			err += dy
+			x0 += sx
+		}
+		if e2 <= dx {
+			err += dx
+			y0 += sy
+		}
+	}
+}
+
+// fillCircle draws a filled circle
+func fillCircle(img *image.RGBA, cx int, cy int, r int, c color.Color) {
+	for y := -r; y <= r; y++ {
+		for x := -r; x <= r; x++ {
+			if x*x+y*y <= r*r {
+				img.Set(cx+x, cy+y, c)
+			}
+		}
+	}
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+	"time"
+)
+
+// countPixels returns how many pixels in a rectangle of an image are a color
+func countPixels(img image.Image, rect image.Rectangle, c color.Color) int {
+	r0, g0, b0, a0 := c.RGBA()
+	count := 0
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			if r == r0 && g == g0 && b == b0 && a == a0 {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func TestDrawText(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	drawText(img, 1, 2, "1", 1, _chartText)
+
+	glyph := _chartFont['1'-' ']
+	for row := 0; row < chartFontHeight; row++ {
+		for col := 0; col < chartFontWidth; col++ {
+			set := img.RGBAAt(1+col, 2+row) == _chartText
+			expected := glyph[row]&(1<<uint(chartFontWidth-1-col)) != 0
+			if set != expected {
+				t.Errorf("pixel %d,%d of '1' is %t, expected %t", col, row, set, expected)
+			}
+		}
+	}
+
+	// each pixel's drawn as a square at a bigger scale
+	single := countPixels(img, img.Bounds(), _chartText)
+	img = image.NewRGBA(image.Rect(0, 0, 40, 20))
+	drawText(img, 0, 0, "1", 2, _chartText)
+	if doubled := countPixels(img, img.Bounds(), _chartText); doubled != 4*single {
+		t.Errorf("got %d pixels at scale 2, expected %d", doubled, 4*single)
+	}
+
+	// characters the font doesn't have are drawn as '?'
+	unknown := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	question := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	drawText(unknown, 0, 0, "é", 1, _chartText)
+	drawText(question, 0, 0, "?", 1, _chartText)
+	if !bytes.Equal(unknown.Pix, question.Pix) {
+		t.Errorf("unknown character wasn't drawn as '?'")
+	}
+
+	if width := textWidth("100%", 1); width != 4*chartFontAdvance-1 {
+		t.Errorf("got width %d", width)
+	}
+	if width := textWidth("", 2); width != 0 {
+		t.Errorf("got width %d for no text", width)
+	}
+}
+
+func TestRenderPNGIsLabelled(t *testing.T) {
+	end := time.Date(2016, 10, 18, 15, 4, 0, 0, time.UTC)
+	start := end.Add(-7 * 24 * time.Hour)
+	chart := &Chart{
+		Title: "Chance of a Trump apocalypse (538 polls-only)",
+		Points: []HistoryPoint{
+			{Time: start, Value: 12.5},
+			{Time: start.Add(3 * 24 * time.Hour), Value: 18.5},
+		},
+		Start: start,
+		End:   end,
+	}
+
+	output := &bytes.Buffer{}
+	if err := chart.RenderPNG(output); err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moveX, moveY := chart.x(chart.Points[1].Time), chart.y(chart.Points[1].Value)
+	regions := map[string]image.Rectangle{
+		"title":        image.Rect(chartMarginLeft, 0, chartWidth-chartMarginRight, chartMarginTop-8),
+		"100% label":   image.Rect(0, chart.y(100)-chartFontHeight, chartMarginLeft-4, chart.y(100)+chartFontHeight),
+		"50% label":    image.Rect(0, chart.y(50)-chartFontHeight, chartMarginLeft-4, chart.y(50)+chartFontHeight),
+		"0% label":     image.Rect(0, chart.y(0)-chartFontHeight, chartMarginLeft-4, chart.y(0)+chartFontHeight),
+		"start time":   image.Rect(chartMarginLeft, chart.y(0)+2, chartWidth/2, chartHeight),
+		"end time":     image.Rect(chartWidth/2, chart.y(0)+2, chartWidth, chartHeight),
+		"move (+6.0%)": image.Rect(moveX-20, moveY-8-chartFontHeight, moveX+20, moveY-7),
+	}
+	for name, region := range regions {
+		if countPixels(img, region, _chartText) == 0 {
+			t.Errorf("%s wasn't drawn", name)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// window of the charts attached to notifications
+const notificationChartWindow = "7d"
+
+// how long a chart can be cached. History compaction thins and drops old points, so a chart's
+// URL can draw a different chart later - it can't be cached forever.
+const chartCacheMaxAge = time.Hour
+
+// seriesChart builds a chart of a series' chance over the window ending at 'end'
+func (s *Server) seriesChart(key string, window string, end time.Time) (*Chart, error) {
+	duration, err := parseWindow(window)
+	if err != nil {
+		return nil, err
+	}
+	since := time.Time{}
+	if duration > 0 {
+		since = end.Add(-duration)
+	}
+
+	source, model := splitSeriesKey(key)
+	points := []HistoryPoint{}
+	for _, point := range s.history.Query(source, model, metricWinProb, since) {
+		// later points are left out, so a chart's URL always draws the same chart
+		if point.Time.Before(end) {
+			points = append(points, point)
+		}
+	}
+	if len(points) == 0 {
+		return nil, fmt.Errorf("No history for %s", key)
+	}
+
+	start := since
+	if start.Before(points[0].Time) {
+		start = points[0].Time
+	}
+	if !start.Before(end) {
+		start = end.Add(-time.Hour)
+	}
+
+	return &Chart{
+		Title:  fmt.Sprintf("Chance of a Trump apocalypse (%s %s)", source, model),
+		Points: points,
+		Start:  start,
+		End:    end,
+	}, nil
+}
+
+// chartURL returns the public URL of a series' chart, versioned by the series' latest change,
+// or "" if there's nothing to link to
+func (s *Server) chartURL(key string, window string, ext string) string {
+	if s.publicURL == "" {
+		return ""
+	}
+	source, model := splitSeriesKey(key)
+	latest, ok := s.history.LatestTime(source, model, metricWinProb)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%s/chart/%s/%s/%s/%d.%s", strings.TrimSuffix(s.publicURL, "/"), source, model, window, latest.Unix(), ext)
+}
+
+// chartPNGBase64 renders a series' notification chart as a base64-encoded PNG, for uploading to Twitter
+func (s *Server) chartPNGBase64(key string) (string, error) {
+	chart, err := s.seriesChart(key, notificationChartWindow, time.Now())
+	if err != nil {
+		return "", err
+	}
+	buf := bytes.Buffer{}
+	if err := chart.RenderPNG(&buf); err != nil {
+		return "", fmt.Errorf("Error rendering chart: %s", err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// handleChart serves /chart/<source>/<model>/<window>/<version>.<png|svg>, where version is the unix
+// time the chart ends at. Later points are left out, so the same URL draws the same chart until
+// history compaction thins the points it draws.
+func (s *Server) handleChart(w http.ResponseWriter, r *http.Request) {
+	logFields := log.Fields{
+		"request": "/chart",
+		"path":    r.URL.Path,
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/chart/"), "/")
+	if len(parts) != 4 {
+		http.NotFound(w, r)
+		return
+	}
+	source, model, window, file := parts[0], parts[1], parts[2], parts[3]
+
+	dot := strings.LastIndex(file, ".")
+	if dot < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	version, err := strconv.ParseInt(file[:dot], 10, 64)
+	ext := file[dot+1:]
+	if err != nil || (ext != "png" && ext != "svg") {
+		http.NotFound(w, r)
+		return
+	}
+
+	// charts can't end in the future, or they'd change
+	end := time.Unix(version+1, 0)
+	if end.After(time.Now()) {
+		http.NotFound(w, r)
+		return
+	}
+
+	known := false
+	for _, key := range s.allSeries() {
+		if key == seriesKey(source, model) {
+			known = true
+		}
+	}
+	if !known {
+		http.NotFound(w, r)
+		return
+	}
+
+	chart, err := s.seriesChart(seriesKey(source, model), window, end)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(chartCacheMaxAge/time.Second)))
+	if ext == "png" {
+		w.Header().Set("Content-Type", "image/png")
+		err = chart.RenderPNG(w)
+	} else {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		err = chart.RenderSVG(w)
+	}
+	if err != nil {
+		log.WithFields(logFields).Errorf("Error rendering chart: %s", err)
+	}
+}
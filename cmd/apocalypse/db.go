@@ -1,8 +1,85 @@
 package main
 
+import (
+	"time"
+)
+
 // Account is a record we store in the DB, holding everything
 // we need about a connected Slack account.
 type Account struct {
 	SlackOAuthResponse
-	ReportedTrumpChance float32 `json:"reported_trump_stance"`
+	ReportedTrumpChance float32            `json:"reported_trump_stance,omitempty"` // deprecated - only read to migrate old data files
+	ReportedChances     map[string]float32 `json:"reported_chances"`                // series key -> chance last reported to the channel
+	Models              []string           `json:"models"`                          // series keys the team wants to hear about - empty means each source's default
+	WatchedStates       []string           `json:"watched_states"`                  // states the channel gets their own alerts for
+	ReportedStates      map[string]float32 `json:"reported_states"`                 // state series key -> chance last reported to the channel
+	ReportedProjections map[string]float32 `json:"reported_projections"`            // projection key -> value last reported to the channel
+	Unsubscribed        bool               `json:"unsubscribed"`                    // notifications are paused, but /trump still works
+	Disabled            bool               `json:"disabled"`                        // the webhook failed permanently - nothing is sent until the bot's reinstalled
+	DisabledReason      string             `json:"disabled_reason,omitempty"`       // why, ex: "channel_is_archived"
+	DisabledAt          *time.Time         `json:"disabled_at,omitempty"`
+}
+
+// accountKey identifies an installation of the bot into a team's channel
+func accountKey(teamID string, channelID string) string {
+	return teamID + ":" + channelID
+}
+
+// migrateServerState upgrades data loaded from an older data file. Returns whether the
+// accounts were re-keyed, in which case the data file should be rewritten.
+func migrateServerState(serverState *ServerState) bool {
+	if serverState.Tokens == nil {
+		serverState.Tokens = make(map[string]*Account)
+	}
+	if serverState.LastTweetedValues == nil {
+		serverState.LastTweetedValues = make(map[string]float32)
+	}
+	if serverState.Forecasts == nil {
+		serverState.Forecasts = make(map[string]*Forecast)
+	}
+
+	// older versions only knew about 538
+	if serverState.LastTweetedValue != 0 {
+		serverState.LastTweetedValues["538"] = serverState.LastTweetedValue
+		serverState.LastTweetedValue = 0
+	}
+	rekeyed := false
+	for key, account := range serverState.Tokens {
+		migrateAccount(account)
+
+		// accounts used to be keyed by team only, so each team could only have one channel
+		if newKey := accountKey(account.TeamID, account.IncomingWebhook.ChannelID); key != newKey {
+			delete(serverState.Tokens, key)
+			serverState.Tokens[newKey] = account
+			rekeyed = true
+		}
+	}
+	return rekeyed
+}
+
+// migrateAccount upgrades an account loaded from an older data file, or freshly created
+func migrateAccount(account *Account) {
+	if account.ReportedChances == nil {
+		account.ReportedChances = make(map[string]float32)
+	}
+	if account.ReportedStates == nil {
+		account.ReportedStates = make(map[string]float32)
+	}
+	if account.ReportedProjections == nil {
+		account.ReportedProjections = make(map[string]float32)
+	}
+	if account.ReportedTrumpChance != 0 {
+		account.ReportedChances["538"] = account.ReportedTrumpChance
+		account.ReportedTrumpChance = 0
+	}
+
+	// chances used to be reported per source, before we knew about models
+	for key, value := range account.ReportedChances {
+		if source, model := splitSeriesKey(key); model == "" {
+			delete(account.ReportedChances, key)
+			if source == "538" {
+				account.ReportedChances[seriesKey(source, "polls-only")] = value
+			}
+		}
+	}
 }
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// kinds of dead letters
+const (
+	deadLetterSlack = "slack"
+	deadLetterTweet = "tweet"
+)
+
+// DeadLetter is a Slack message or tweet we gave up on, kept so it can be looked at, and retried or discarded
+type DeadLetter struct {
+	ID         string            `json:"id"`
+	Kind       string            `json:"kind"` // "slack" or "tweet"
+	FailedAt   time.Time         `json:"failed_at"`
+	Attempts   int               `json:"attempts"`
+	Error      string            `json:"error"`                 // can include the webhook URL, so it's encrypted like it
+	Reason     string            `json:"reason,omitempty"`      // Slack's error code, for failures that weren't retried
+	StatusCode int               `json:"status_code,omitempty"` // HTTP status of the last attempt, if we got one
+	Slack      *DeadSlackMessage `json:"slack,omitempty"`
+	Tweet      *DeadTweet        `json:"tweet,omitempty"`
+}
+
+// DeadSlackMessage is a Slack message that couldn't be delivered
+type DeadSlackMessage struct {
+	AccountKey string    `json:"account_key,omitempty"` // empty for slash command responses
+	URL        string    `json:"url"`                   // encrypted on disk, if there's a keyring
+	Message    string    `json:"message"`
+	Quip       string    `json:"quip"`
+	ImageURL   string    `json:"image_url,omitempty"`
+	QueuedAt   time.Time `json:"queued_at"`
+}
+
+// DeadTweet is a tweet that couldn't be sent
+type DeadTweet struct {
+	Source        string  `json:"source"`
+	URL           string  `json:"url"`
+	ChartKey      string  `json:"chart_key"`
+	PercentNow    float32 `json:"percent_now"`
+	PercentChange float32 `json:"percent_change"`
+}
+
+// DeadLetters stores dead letters on disk, one JSON file each
+type DeadLetters struct {
+	dirPath string
+	keyring *Keyring // webhook URLs and errors are encrypted with it, if it's set
+	mutex   sync.Mutex
+	letters map[string]*DeadLetter // by ID
+	lastID  int64                  // IDs are failure times, in nanoseconds, bumped to be unique
+}
+
+// OpenDeadLetters loads the dead letters in a directory, creating it if needed. Dead letters with secrets
+// in plaintext, or encrypted with an old key, are rewritten.
+func OpenDeadLetters(dirPath string, keyring *Keyring) (*DeadLetters, error) {
+	if err := os.MkdirAll(dirPath, 0755); err != nil {
+		return nil, fmt.Errorf("Error creating dead letter directory: %s", err)
+	}
+	files, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading dead letter directory: %s", err)
+	}
+
+	d := &DeadLetters{
+		dirPath: dirPath,
+		keyring: keyring,
+		letters: make(map[string]*DeadLetter),
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			os.Remove(filepath.Join(dirPath, file.Name()))
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dirPath, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("Error reading dead letter %s: %s", file.Name(), err)
+		}
+		letter := &DeadLetter{}
+		if err := json.Unmarshal(data, letter); err != nil || letter.ID == "" {
+			log.WithFields(log.Fields{
+				"area": "deadletters",
+				"file": file.Name(),
+			}).Errorf("Skipping unreadable dead letter: %v", err)
+			continue
+		}
+		stale := false
+		for _, secret := range letter.secrets() {
+			plaintext, staleSecret, err := decryptSecret(keyring, *secret)
+			if err != nil {
+				return nil, fmt.Errorf("Error decrypting dead letter %s: %s", file.Name(), err)
+			}
+			*secret = plaintext
+			stale = stale || staleSecret
+		}
+		if stale {
+			if err := d.write(letter); err != nil {
+				return nil, err
+			}
+		}
+		d.letters[letter.ID] = letter
+		if letter.FailedAt.UnixNano() > d.lastID {
+			d.lastID = letter.FailedAt.UnixNano()
+		}
+	}
+	return d, nil
+}
+
+// Add stores a dead letter, giving it an ID
+func (d *DeadLetters) Add(letter *DeadLetter) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	id := letter.FailedAt.UnixNano()
+	if id <= d.lastID {
+		id = d.lastID + 1
+	}
+	letter.ID = fmt.Sprintf("%020d", id)
+
+	if err := d.write(letter); err != nil {
+		return err
+	}
+	d.letters[letter.ID] = letter
+	d.lastID = id
+	return nil
+}
+
+// write stores a dead letter, with its secrets encrypted
+func (d *DeadLetters) write(letter *DeadLetter) error {
+	stored := *letter
+	if letter.Slack != nil {
+		slack := *letter.Slack
+		stored.Slack = &slack
+	}
+	for _, secret := range stored.secrets() {
+		ciphertext, err := encryptSecret(d.keyring, *secret)
+		if err != nil {
+			return fmt.Errorf("Error encrypting dead letter: %s", err)
+		}
+		*secret = ciphertext
+	}
+
+	data, err := json.MarshalIndent(&stored, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error marshalling dead letter: %s", err)
+	}
+	if err := writeFileSynced(d.letterPath(letter.ID), data, 0600); err != nil {
+		return fmt.Errorf("Error writing dead letter: %s", err)
+	}
+	return nil
+}
+
+// secrets returns the fields of a dead letter that are encrypted at rest: a Slack message's
+// webhook URL, and the error, which can include it
+func (letter *DeadLetter) secrets() []*string {
+	secrets := []*string{&letter.Error}
+	if letter.Slack != nil {
+		secrets = append(secrets, &letter.Slack.URL)
+	}
+	return secrets
+}
+
+// List returns every dead letter, oldest first
+func (d *DeadLetters) List() []*DeadLetter {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	letters := []*DeadLetter{}
+	for _, letter := range d.letters {
+		letters = append(letters, letter)
+	}
+	sort.Slice(letters, func(i, j int) bool {
+		return letters[i].ID < letters[j].ID
+	})
+	return letters
+}
+
+// Get returns a dead letter by ID
+func (d *DeadLetters) Get(id string) (*DeadLetter, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	letter, ok := d.letters[id]
+	return letter, ok
+}
+
+// Remove deletes a dead letter. Returns false if there wasn't one with the ID.
+func (d *DeadLetters) Remove(id string) (bool, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if _, ok := d.letters[id]; !ok {
+		return false, nil
+	}
+	if err := d.deleteFile(id); err != nil {
+		return true, fmt.Errorf("Error removing dead letter: %s", err)
+	}
+	delete(d.letters, id)
+	return true, nil
+}
+
+// take drops a dead letter from the list, so it can't be retried twice, but leaves its file until
+// deleteFile is called, so it's still there after a restart. Returns false if there wasn't one with the ID.
+func (d *DeadLetters) take(id string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if _, ok := d.letters[id]; !ok {
+		return false
+	}
+	delete(d.letters, id)
+	return true
+}
+
+// deleteFile deletes the file of a dead letter that's been taken
+func (d *DeadLetters) deleteFile(id string) error {
+	if err := os.Remove(d.letterPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Len returns how many dead letters there are
+func (d *DeadLetters) Len() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return len(d.letters)
+}
+
+func (d *DeadLetters) letterPath(id string) string {
+	return filepath.Join(d.dirPath, id+".json")
+}
+
+// deadLetterSlackMessage stores a Slack message we gave up on
+func (s *Server) deadLetterSlackMessage(slackMessage SlackMessage, attempts int, err error, reason string) {
+	letter := &DeadLetter{
+		Kind:     deadLetterSlack,
+		FailedAt: time.Now(),
+		Attempts: attempts,
+		Error:    err.Error(),
+		Reason:   reason,
+		Slack: &DeadSlackMessage{
+			AccountKey: slackMessage.accountKey,
+			URL:        slackMessage.url,
+			Message:    slackMessage.message,
+			Quip:       slackMessage.quip,
+			ImageURL:   slackMessage.imageURL,
+			QueuedAt:   slackMessage.queuedAt,
+		},
+	}
+	if httpErr, ok := err.(*HTTPError); ok {
+		letter.StatusCode = httpErr.StatusCode
+	}
+	s.addDeadLetter(letter, slackMessage.logFields)
+}
+
+// deadLetterTweet stores a tweet we gave up on
+func (s *Server) deadLetterTweet(tweet Tweet, attempts int, err error) {
+	s.addDeadLetter(&DeadLetter{
+		Kind:     deadLetterTweet,
+		FailedAt: time.Now(),
+		Attempts: attempts,
+		Error:    err.Error(),
+		Tweet: &DeadTweet{
+			Source:        tweet.source,
+			URL:           tweet.url,
+			ChartKey:      tweet.chartKey,
+			PercentNow:    tweet.percentNow,
+			PercentChange: tweet.percentChange,
+		},
+	}, tweet.logFields)
+}
+
+func (s *Server) addDeadLetter(letter *DeadLetter, logFields log.Fields) {
+	incrementMetric("dead_letters")
+	if err := s.deadLetters.Add(letter); err != nil {
+		log.WithFields(logFields).Errorf("Error storing dead letter: %s", err)
+		return
+	}
+	log.WithFields(logFields).Warnf("Stored %s dead letter %s", letter.Kind, letter.ID)
+}
+
+// retryDeadLetter takes a dead letter out of the store and queues it again. Its file's only deleted once
+// it's queued, so it's kept if we stop first. If it fails again, it's stored again under a new ID. A retried Slack message doesn't change what its channel was last told,
+// and a retried tweet doesn't change what was last tweeted, since newer values may have been sent since.
+func (s *Server) retryDeadLetter(letter *DeadLetter) error {
+	if letter.Kind == deadLetterTweet && s.twitterAPI == nil {
+		return fmt.Errorf("Twitter isn't configured")
+	}
+	if !s.startWork() {
+		return fmt.Errorf("The server is shutting down")
+	}
+	if !s.deadLetters.take(letter.ID) {
+		s.waitGroup.Done()
+		return fmt.Errorf("Dead letter %s was already removed", letter.ID)
+	}
+
+	logFields := log.Fields{
+		"area":       letter.Kind,
+		"deadLetter": letter.ID,
+	}
+	log.WithFields(logFields).Infof("Retrying dead letter")
+
+	switch letter.Kind {
+	case deadLetterTweet:
+		logFields["source"] = letter.Tweet.Source
+		s.tweetChan <- Tweet{
+			source:        letter.Tweet.Source,
+			url:           letter.Tweet.URL,
+			chartKey:      letter.Tweet.ChartKey,
+			percentNow:    letter.Tweet.PercentNow,
+			percentChange: letter.Tweet.PercentChange,
+			retried:       true,
+			logFields:     logFields,
+		}
+	default:
+		logFields["account"] = letter.Slack.AccountKey
+		s.outChan <- SlackMessage{
+			queuedAt:   time.Now(),
+			accountKey: letter.Slack.AccountKey,
+			url:        letter.Slack.URL,
+			message:    letter.Slack.Message,
+			quip:       letter.Slack.Quip,
+			imageURL:   letter.Slack.ImageURL,
+			logFields:  logFields,
+		}
+	}
+
+	// it's queued now, so Shutdown waits for it - if the file can't be deleted, it'll be back after a restart
+	if err := s.deadLetters.deleteFile(letter.ID); err != nil {
+		log.WithFields(logFields).Errorf("Error removing retried dead letter: %s", err)
+	}
+	return nil
+}
+
+// handleDeadLetters is the admin API for dead letters:
+//
+//	GET    /admin/dead-letters            - list them, oldest first
+//	GET    /admin/dead-letters/<id>       - look at one
+//	POST   /admin/dead-letters/<id>/retry - queue it again
+//	DELETE /admin/dead-letters/<id>       - discard it
+func (s *Server) handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	logFields := log.Fields{
+		"request": r.URL.Path,
+		"method":  r.Method,
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/dead-letters"), "/")
+	if path == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeAdminJSON(w, s.deadLetters.List(), logFields)
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	letter, ok := s.deadLetters.Get(parts[0])
+	if !ok || len(parts) > 2 || (len(parts) == 2 && parts[1] != "retry") {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case len(parts) == 2 && r.Method == http.MethodPost:
+		if err := s.retryDeadLetter(letter); err != nil {
+			log.WithFields(logFields).Errorf("Error retrying dead letter: %s", err)
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		writeAdminJSON(w, letter, logFields)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		if _, err := s.deadLetters.Remove(letter.ID); err != nil {
+			log.WithFields(logFields).Errorf("Error discarding dead letter: %s", err)
+			http.Error(w, "error", http.StatusInternalServerError)
+			return
+		}
+		log.WithFields(logFields).Infof("Discarded dead letter")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// runDeadLettersCommand handles "apocalypse dead-letters ...", which manages the dead letters of a
+// running server through its admin API. Returns the exit code.
+func runDeadLettersCommand(args []string) int {
+	flags := flag.NewFlagSet("dead-letters", flag.ExitOnError)
+	serverURL := flags.String("server", "http://localhost:8080", "URL of the running server")
+	flags.Usage = func() {
+		fmt.Println("apocalypse2016 dead-letters usage:")
+		fmt.Println("  apocalypse dead-letters [-server <url>] list")
+		fmt.Println("  apocalypse dead-letters [-server <url>] show <id>")
+		fmt.Println("  apocalypse dead-letters [-server <url>] retry <id>")
+		fmt.Println("  apocalypse dead-letters [-server <url>] discard <id>")
+		flags.PrintDefaults()
+		fmt.Println("\nThe ADMIN_TOKEN environment variable must match the server's.")
+	}
+	flags.Parse(args)
+
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	if adminToken == "" || flags.NArg() == 0 || (flags.Arg(0) != "list" && flags.NArg() != 2) {
+		flags.Usage()
+		return -1
+	}
+	baseURL := strings.TrimRight(*serverURL, "/") + "/admin/dead-letters"
+
+	var method, url string
+	switch flags.Arg(0) {
+	case "list":
+		method, url = http.MethodGet, baseURL
+	case "show":
+		method, url = http.MethodGet, baseURL+"/"+flags.Arg(1)
+	case "retry":
+		method, url = http.MethodPost, baseURL+"/"+flags.Arg(1)+"/retry"
+	case "discard":
+		method, url = http.MethodDelete, baseURL+"/"+flags.Arg(1)
+	default:
+		flags.Usage()
+		return -1
+	}
+
+	body, err := adminRequest(method, url, adminToken)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		return -1
+	}
+
+	switch flags.Arg(0) {
+	case "list":
+		letters := []*DeadLetter{}
+		if err := json.Unmarshal(body, &letters); err != nil {
+			fmt.Printf("Error reading dead letters: %s\n", err)
+			return -1
+		}
+		if len(letters) == 0 {
+			fmt.Println("No dead letters")
+		}
+		for _, letter := range letters {
+			fmt.Println(deadLetterSummary(letter))
+		}
+	case "show":
+		fmt.Print(string(body))
+	case "retry":
+		fmt.Printf("Queued %s again\n", flags.Arg(1))
+	case "discard":
+		fmt.Printf("Discarded %s\n", flags.Arg(1))
+	}
+	return 0
+}
+
+// send an authenticated request to the admin API, returning the response body
+func adminRequest(method string, url string, adminToken string) ([]byte, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// deadLetterSummary describes a dead letter on one line
+func deadLetterSummary(letter *DeadLetter) string {
+	target := ""
+	switch {
+	case letter.Slack != nil && letter.Slack.AccountKey != "":
+		target = letter.Slack.AccountKey
+	case letter.Slack != nil:
+		target = "slash command response"
+	case letter.Tweet != nil:
+		target = fmt.Sprintf("%s %.1f%%", letter.Tweet.Source, letter.Tweet.PercentNow)
+	}
+	return fmt.Sprintf("%s  %-5s  %s  %-30s  %d attempts: %s",
+		letter.ID, letter.Kind, letter.FailedAt.Format(time.RFC3339), target, letter.Attempts, letter.Error)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRetryDeadLetterKeepsFileUntilQueued(t *testing.T) {
+	server := newTestServer(t)
+	slackID, _ := addTestDeadLetters(t, server)
+	letter, _ := server.deadLetters.Get(slackID)
+	letterPath := server.deadLetters.letterPath(slackID)
+
+	// nothing's reading the queue yet, so the retry's stuck handing the message off
+	server.outChan = make(chan SlackMessage)
+	retried := make(chan error)
+	go func() {
+		retried <- server.retryDeadLetter(letter)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := server.deadLetters.Get(slackID); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("dead letter wasn't taken for retrying")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// it can't be retried twice, and its file's kept until it's queued
+	if err := server.retryDeadLetter(letter); err == nil {
+		t.Errorf("retried a dead letter that's already being retried")
+	}
+	if _, err := os.Stat(letterPath); err != nil {
+		t.Errorf("dead letter file was deleted before the retry was queued: %s", err)
+	}
+
+	slackMessage := <-server.outChan
+	if err := <-retried; err != nil {
+		t.Fatal(err)
+	}
+	if slackMessage.url != testWebhookURL || slackMessage.message != letter.Slack.Message {
+		t.Errorf("got retried message %+v", slackMessage)
+	}
+	if _, err := os.Stat(letterPath); !os.IsNotExist(err) {
+		t.Errorf("dead letter file wasn't deleted once the retry was queued: %v", err)
+	}
+	server.waitGroup.Done()
+}
+
+func TestRetryDeadLetterAfterShutdown(t *testing.T) {
+	server := newTestServer(t)
+	slackID, _ := addTestDeadLetters(t, server)
+	letter, _ := server.deadLetters.Get(slackID)
+
+	close(server.runDone)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the queues are closed, so nothing can be sent - the dead letter stays where it is
+	if err := server.retryDeadLetter(letter); err == nil {
+		t.Fatalf("retried a dead letter after shutting down")
+	}
+	if _, ok := server.deadLetters.Get(slackID); !ok {
+		t.Errorf("dead letter was dropped by a retry that didn't happen")
+	}
+	if _, err := os.Stat(server.deadLetters.letterPath(slackID)); err != nil {
+		t.Errorf("dead letter file was deleted by a retry that didn't happen: %s", err)
+	}
+}
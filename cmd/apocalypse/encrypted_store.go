@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"os"
+	"sync"
+)
+
+// EncryptedStore encrypts each account's OAuth tokens and webhook URL before they're stored by
+// another Store, and decrypts them when they're loaded. Without a keyring, secrets are stored in
+// plaintext, and encrypted ones can't be loaded.
+type EncryptedStore struct {
+	store   Store
+	keyring *Keyring // nil to store secrets in plaintext
+
+	mutex     sync.Mutex
+	encrypted map[string]string // plaintext -> its ciphertext, so unchanged secrets are stored unchanged
+}
+
+// NewEncryptedStore returns a new EncryptedStore
+func NewEncryptedStore(store Store, keyring *Keyring) *EncryptedStore {
+	return &EncryptedStore{
+		store:     store,
+		keyring:   keyring,
+		encrypted: make(map[string]string),
+	}
+}
+
+// accountSecrets returns the fields of an account that are encrypted at rest
+func accountSecrets(account *Account) []*string {
+	return []*string{
+		&account.AccessToken,
+		&account.Bot.AccessToken,
+		&account.IncomingWebhook.URL,
+	}
+}
+
+// Load loads the server state, decrypting its secrets. Secrets that are in plaintext, or encrypted
+// with an old key, are re-encrypted with the primary key and saved straight away.
+func (e *EncryptedStore) Load() (*ServerState, error) {
+	serverState, err := e.store.Load()
+	if err != nil {
+		return nil, err
+	}
+	stale, err := e.decryptSecrets(serverState)
+	if err != nil {
+		return nil, err
+	}
+
+	if stale > 0 {
+		log.WithFields(log.Fields{
+			"area":    "db",
+			"secrets": stale,
+		}).Infof("Re-encrypting secrets that are in plaintext or use an old key")
+		if err := e.reencrypt(serverState); err != nil {
+			return nil, fmt.Errorf("Error re-encrypting secrets: %s", err)
+		}
+	}
+	return serverState, nil
+}
+
+// reencrypt saves the server state with its secrets encrypted with the primary key, without leaving
+// the old values lying around. A backup that can't be re-encrypted is logged and left as it is, since
+// it's no reason not to start.
+func (e *EncryptedStore) reencrypt(serverState *ServerState) error {
+	encryptedState, err := e.encryptSecrets(serverState)
+	if err != nil {
+		return err
+	}
+
+	switch store := e.store.(type) {
+	case *FileStore:
+		// backing up the file we're replacing would keep the old secrets - re-encrypt the backups instead
+		if err := store.save(encryptedState, false); err != nil {
+			return err
+		}
+		backups, err := listBackups(store.filePath)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"area": "db",
+			}).Errorf("Error listing backups to re-encrypt: %s", err)
+			return nil
+		}
+		for _, backup := range backups {
+			if _, err := e.reencryptBackup(store.filePath, backup); err != nil {
+				log.WithFields(log.Fields{
+					"area":   "db",
+					"backup": backup.ID(),
+				}).Errorf("Error re-encrypting backup - skipping it: %s", err)
+			}
+		}
+		return nil
+	case *KVStore:
+		// don't leave the old values in the database's log
+		if err := store.Save(encryptedState); err != nil {
+			return err
+		}
+		return store.Compact()
+	default:
+		return e.store.Save(encryptedState)
+	}
+}
+
+// reencryptBackup re-encrypts a backup's secrets with the primary key, compressing it if it wasn't.
+// Returns how many secrets were re-encrypted.
+func (e *EncryptedStore) reencryptBackup(dataFilePath string, backup Backup) (int, error) {
+	data, err := backup.read()
+	if err != nil {
+		return 0, err
+	}
+	serverState := &ServerState{}
+	if err := json.Unmarshal(data, serverState); err != nil {
+		return 0, fmt.Errorf("Error parsing backup: %s", err)
+	}
+	stale, err := e.decryptSecrets(serverState)
+	if err != nil || stale == 0 {
+		return 0, err
+	}
+
+	encryptedState, err := e.encryptSecrets(serverState)
+	if err != nil {
+		return 0, err
+	}
+	if data, err = json.Marshal(encryptedState); err != nil {
+		return 0, fmt.Errorf("Error marshalling backup: %s", err)
+	}
+	if err := writeCompressed(backupPath(dataFilePath, backup.Time), data); err != nil {
+		return 0, fmt.Errorf("Error writing backup: %s", err)
+	}
+	if !backup.Compressed {
+		if err := os.Remove(backup.Path); err != nil {
+			return 0, fmt.Errorf("Error removing uncompressed backup: %s", err)
+		}
+	}
+	return stale, nil
+}
+
+// Save encrypts the server state's secrets, then saves it. The state passed in isn't changed.
+func (e *EncryptedStore) Save(serverState *ServerState) error {
+	encryptedState, err := e.encryptSecrets(serverState)
+	if err != nil {
+		return err
+	}
+	return e.store.Save(encryptedState)
+}
+
+// decryptSecrets decrypts the secrets of the server state in place. Returns how many are stale - in
+// plaintext or encrypted with an old key - and need to be encrypted with the primary key.
+func (e *EncryptedStore) decryptSecrets(serverState *ServerState) (int, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	stale := 0
+	for key, account := range serverState.Tokens {
+		for _, secret := range accountSecrets(account) {
+			if !isEncrypted(*secret) {
+				if *secret != "" && e.keyring != nil {
+					stale++
+				}
+				continue
+			}
+			if e.keyring == nil {
+				return 0, fmt.Errorf("Account %s has encrypted secrets, but no encryption keys were given", key)
+			}
+			plaintext, rotated, err := e.keyring.Decrypt(*secret)
+			if err != nil {
+				return 0, fmt.Errorf("Error decrypting account %s: %s", key, err)
+			}
+			if rotated {
+				stale++
+			} else {
+				e.encrypted[plaintext] = *secret
+			}
+			*secret = plaintext
+		}
+	}
+	return stale, nil
+}
+
+// encryptSecrets returns a copy of the server state with its secrets encrypted
+func (e *EncryptedStore) encryptSecrets(serverState *ServerState) (*ServerState, error) {
+	if e.keyring == nil {
+		return serverState, nil
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	encryptedState := *serverState
+	encryptedState.Tokens = make(map[string]*Account, len(serverState.Tokens))
+	for key, account := range serverState.Tokens {
+		encryptedAccount := *account
+		for _, secret := range accountSecrets(&encryptedAccount) {
+			if *secret == "" {
+				continue
+			}
+			ciphertext, ok := e.encrypted[*secret]
+			if !ok {
+				var err error
+				if ciphertext, err = e.keyring.Encrypt(*secret); err != nil {
+					return nil, fmt.Errorf("Error encrypting account %s: %s", key, err)
+				}
+				e.encrypted[*secret] = ciphertext
+			}
+			*secret = ciphertext
+		}
+		encryptedState.Tokens[key] = &encryptedAccount
+	}
+	return &encryptedState, nil
+}
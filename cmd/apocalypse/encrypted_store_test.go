@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestDataFile returns the path of a data file in a temp directory
+func newTestDataFile(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "apocalypse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	return filepath.Join(dir, "data.json")
+}
+
+// newTestServerState returns a server state with one account, with all of its secrets set
+func newTestServerState() *ServerState {
+	account := &Account{TeamID: "T0001", TeamName: "Test Team", AccessToken: testUserToken}
+	account.IncomingWebhook.ChannelID = "C0001"
+	account.IncomingWebhook.URL = testWebhookURL
+	account.Bot.AccessToken = testBotToken
+	return &ServerState{Tokens: map[string]*Account{accountKey("T0001", "C0001"): account}}
+}
+
+// assertTestSecrets fails if the loaded state's secrets aren't the ones newTestServerState set
+func assertTestSecrets(t *testing.T, serverState *ServerState) {
+	account, ok := serverState.Tokens[accountKey("T0001", "C0001")]
+	if !ok {
+		t.Fatalf("account is missing")
+	}
+	if account.AccessToken != testUserToken || account.Bot.AccessToken != testBotToken || account.IncomingWebhook.URL != testWebhookURL {
+		t.Errorf("got secrets %q, %q, %q", account.AccessToken, account.Bot.AccessToken, account.IncomingWebhook.URL)
+	}
+}
+
+// assertFileEncrypted fails if a file contains any of the plaintext secrets, or isn't encrypted with the key
+func assertFileEncrypted(t *testing.T, data []byte, keyID string) {
+	for _, secret := range []string{testUserToken, testBotToken, testWebhookURL} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("file contains %q: %s", secret, data)
+		}
+	}
+	if !strings.Contains(string(data), encryptedPrefix+keyID+":") {
+		t.Errorf("file isn't encrypted with key %s: %s", keyID, data)
+	}
+}
+
+// writeTestBackup writes an uncompressed backup of the data file, as older versions did
+func writeTestBackup(t *testing.T, dataFilePath string, backupTime time.Time, data []byte) string {
+	path := fmt.Sprintf("%s.%d", dataFilePath, backupTime.Unix())
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEncryptedStoreRoundTrip(t *testing.T) {
+	dataFilePath := newTestDataFile(t)
+	keyring, _ := newTestKeyring(t, "k1")
+
+	serverState := newTestServerState()
+	if err := NewEncryptedStore(NewFileStore(dataFilePath, defaultBackupPolicy), keyring).Save(serverState); err != nil {
+		t.Fatal(err)
+	}
+	assertTestSecrets(t, serverState)
+
+	data, err := ioutil.ReadFile(dataFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFileEncrypted(t, data, "k1")
+
+	loaded, err := NewEncryptedStore(NewFileStore(dataFilePath, defaultBackupPolicy), keyring).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTestSecrets(t, loaded)
+
+	// saving again without changes leaves the file as it was
+	store := NewEncryptedStore(NewFileStore(dataFilePath, defaultBackupPolicy), keyring)
+	if loaded, err = store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(loaded); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := ioutil.ReadFile(dataFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(saved) != string(data) {
+		t.Errorf("unchanged secrets were encrypted again")
+	}
+}
+
+func TestEncryptedStoreEncryptsPlaintext(t *testing.T) {
+	dataFilePath := newTestDataFile(t)
+	keyring, _ := newTestKeyring(t, "k1")
+
+	// a data file and backup from before encryption was turned on
+	fileStore := NewFileStore(dataFilePath, defaultBackupPolicy)
+	if err := fileStore.Save(newTestServerState()); err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := ioutil.ReadFile(dataFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestBackup(t, dataFilePath, time.Now().Add(-time.Hour), plaintext)
+
+	loaded, err := NewEncryptedStore(fileStore, keyring).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTestSecrets(t, loaded)
+
+	data, err := ioutil.ReadFile(dataFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFileEncrypted(t, data, "k1")
+	backups, err := listBackups(dataFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 || !backups[0].Compressed {
+		t.Fatalf("expected the backup to be replaced by a compressed one: %+v", backups)
+	}
+	if data, err = backups[0].read(); err != nil {
+		t.Fatal(err)
+	}
+	assertFileEncrypted(t, data, "k1")
+}
+
+func TestEncryptedStoreKeyRotation(t *testing.T) {
+	dataFilePath := newTestDataFile(t)
+	oldKeyring, oldKeys := newTestKeyring(t, "old")
+	newKeyring, newKeys := newTestKeyring(t, "new")
+	rotatedKeyring, err := ParseKeyring(newKeys[0] + "," + oldKeys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := NewEncryptedStore(NewFileStore(dataFilePath, defaultBackupPolicy), oldKeyring).Save(newTestServerState()); err != nil {
+		t.Fatal(err)
+	}
+	oldData, err := ioutil.ReadFile(dataFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestBackup(t, dataFilePath, time.Now().Add(-time.Hour), oldData)
+
+	// the new key can't read it alone
+	if _, err := NewEncryptedStore(NewFileStore(dataFilePath, defaultBackupPolicy), newKeyring).Load(); err == nil {
+		t.Fatalf("loaded secrets encrypted with a key that isn't in the keyring")
+	}
+
+	// with both, everything's re-encrypted with the new key
+	loaded, err := NewEncryptedStore(NewFileStore(dataFilePath, defaultBackupPolicy), rotatedKeyring).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTestSecrets(t, loaded)
+	data, err := ioutil.ReadFile(dataFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFileEncrypted(t, data, "new")
+	backups, err := listBackups(dataFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, backup := range backups {
+		if data, err = backup.read(); err != nil {
+			t.Fatal(err)
+		}
+		assertFileEncrypted(t, data, "new")
+	}
+
+	// so the old key can be dropped
+	loaded, err = NewEncryptedStore(NewFileStore(dataFilePath, defaultBackupPolicy), newKeyring).Load()
+	if err != nil {
+		t.Fatalf("Error loading with the new key alone: %s", err)
+	}
+	assertTestSecrets(t, loaded)
+}
+
+func TestEncryptedStoreWrongOrMissingKey(t *testing.T) {
+	dataFilePath := newTestDataFile(t)
+	keyring, _ := newTestKeyring(t, "k1")
+	if err := NewEncryptedStore(NewFileStore(dataFilePath, defaultBackupPolicy), keyring).Save(newTestServerState()); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(dataFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewEncryptedStore(NewFileStore(dataFilePath, defaultBackupPolicy), nil).Load(); err == nil || !strings.Contains(err.Error(), "no encryption keys") {
+		t.Errorf("got error %v without a keyring", err)
+	}
+	wrongKeyring, _ := newTestKeyring(t, "k1")
+	if _, err := NewEncryptedStore(NewFileStore(dataFilePath, defaultBackupPolicy), wrongKeyring).Load(); err == nil {
+		t.Errorf("loaded with the wrong key")
+	}
+
+	// failing to load doesn't touch the file
+	after, err := ioutil.ReadFile(dataFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(data) {
+		t.Errorf("data file was changed by a failed load")
+	}
+}
+
+func TestEncryptedStoreTamperedCiphertext(t *testing.T) {
+	dataFilePath := newTestDataFile(t)
+	keyring, _ := newTestKeyring(t, "k1")
+	store := NewEncryptedStore(NewFileStore(dataFilePath, defaultBackupPolicy), keyring)
+	if err := store.Save(newTestServerState()); err != nil {
+		t.Fatal(err)
+	}
+
+	// swap one account's encrypted token for another - each is valid, but not where it's used
+	fileStore := NewFileStore(dataFilePath, defaultBackupPolicy)
+	serverState, err := fileStore.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := serverState.Tokens[accountKey("T0001", "C0001")]
+	parts := strings.Split(account.AccessToken, ":")
+	otherParts := strings.Split(account.Bot.AccessToken, ":")
+	parts[len(parts)-1] = otherParts[len(otherParts)-1]
+	account.AccessToken = strings.Join(parts, ":")
+	if err := fileStore.save(serverState, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewEncryptedStore(NewFileStore(dataFilePath, defaultBackupPolicy), keyring).Load(); err == nil {
+		t.Errorf("loaded a tampered secret")
+	}
+}
+
+func TestEncryptedStoreSkipsBadBackups(t *testing.T) {
+	dataFilePath := newTestDataFile(t)
+	keyring, _ := newTestKeyring(t, "k1")
+
+	fileStore := NewFileStore(dataFilePath, defaultBackupPolicy)
+	if err := fileStore.Save(newTestServerState()); err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := ioutil.ReadFile(dataFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	badPath := writeTestBackup(t, dataFilePath, time.Now().Add(-2*time.Hour), []byte("not JSON"))
+	writeTestBackup(t, dataFilePath, time.Now().Add(-time.Hour), plaintext)
+
+	var loaded *ServerState
+	output := captureLogs(t, func() {
+		loaded, err = NewEncryptedStore(fileStore, keyring).Load()
+	})
+	if err != nil {
+		t.Fatalf("a bad backup stopped the data file loading: %s", err)
+	}
+	assertTestSecrets(t, loaded)
+	if !strings.Contains(output, "Error re-encrypting backup") {
+		t.Errorf("bad backup wasn't logged:\n%s", output)
+	}
+	assertNoSecrets(t, output)
+
+	// the good backup was still re-encrypted, and the bad one left alone
+	backups, err := listBackups(dataFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, backup := range backups {
+		data, err := backup.read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if backup.Path == badPath {
+			if string(data) != "not JSON" {
+				t.Errorf("bad backup was changed")
+			}
+			continue
+		}
+		assertFileEncrypted(t, data, "k1")
+	}
+	if len(backups) != 2 {
+		t.Errorf("got %d backups, expected 2", len(backups))
+	}
+}
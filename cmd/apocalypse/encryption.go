@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// encrypted values look like "enc:v1:<key ID>:<wrapped data key>:<ciphertext>"
+const encryptedPrefix = "enc:v1:"
+
+// Keyring holds the keys secrets are encrypted with. Each secret gets its own random data key, which
+// is encrypted ("wrapped") with the primary key and stored alongside it. Older keys are only used to
+// decrypt, so keys can be rotated by adding a new primary key and re-encrypting.
+type Keyring struct {
+	primaryID string
+	keys      map[string]cipher.AEAD // by key ID
+}
+
+// ParseKeyring parses keys in the form "<id>:<base64 32-byte key>", separated by commas or newlines.
+// The first key is the primary key. Blank lines and lines starting with # are ignored.
+func ParseKeyring(text string) (*Keyring, error) {
+	keyring := &Keyring{
+		keys: make(map[string]cipher.AEAD),
+	}
+	for _, line := range strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == '\n' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Keys must look like <id>:<base64 key>")
+		}
+		id := parts[0]
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("Key %s must be 32 bytes, base64-encoded", id)
+		}
+		if _, ok := keyring.keys[id]; ok {
+			return nil, fmt.Errorf("Key %s is listed twice", id)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		keyring.keys[id] = aead
+		if keyring.primaryID == "" {
+			keyring.primaryID = id
+		}
+	}
+	if keyring.primaryID == "" {
+		return nil, fmt.Errorf("No keys found")
+	}
+	return keyring, nil
+}
+
+// LoadKeyring reads keys from a file, or if there's no file, from the environment. Returns nil
+// if neither has any keys.
+func LoadKeyring(keyFilePath string, env string) (*Keyring, error) {
+	if keyFilePath != "" {
+		data, err := ioutil.ReadFile(keyFilePath)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading key file: %s", err)
+		}
+		return ParseKeyring(string(data))
+	}
+	if env != "" {
+		return ParseKeyring(env)
+	}
+	return nil, nil
+}
+
+// generateKey returns a new random key, in the form ParseKeyring reads
+func generateKey(id string) (string, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+	return id + ":" + base64.StdEncoding.EncodeToString(key), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts with a random nonce, which is prepended to the ciphertext
+func seal(aead cipher.AEAD, plaintext []byte, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open decrypts what seal encrypted
+func open(aead cipher.AEAD, sealed []byte, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext is too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additionalData)
+}
+
+// Encrypt encrypts a secret with a new data key, wrapped with the primary key
+func (k *Keyring) Encrypt(plaintext string) (string, error) {
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	// the key ID is authenticated along with the wrapped key, so it can't be swapped
+	wrappedKey, err := seal(k.keys[k.primaryID], dataKey, []byte(k.primaryID))
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := seal(dataAEAD, []byte(plaintext), nil)
+	if err != nil {
+		return "", err
+	}
+	return encryptedPrefix + k.primaryID + ":" + base64.RawURLEncoding.EncodeToString(wrappedKey) +
+		":" + base64.RawURLEncoding.EncodeToString(ciphertext), nil
+}
+
+// Decrypt decrypts a secret that Encrypt encrypted, with whichever key it was encrypted with. Also
+// returns whether it should be re-encrypted, because it wasn't encrypted with the primary key.
+func (k *Keyring) Decrypt(value string) (string, bool, error) {
+	keyID, wrappedKey, ciphertext, err := splitEncrypted(value)
+	if err != nil {
+		return "", false, err
+	}
+	keyAEAD, ok := k.keys[keyID]
+	if !ok {
+		return "", false, fmt.Errorf("Secret was encrypted with unknown key %s", keyID)
+	}
+	dataKey, err := open(keyAEAD, wrappedKey, []byte(keyID))
+	if err != nil {
+		return "", false, fmt.Errorf("Error unwrapping data key with key %s: %s", keyID, err)
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", false, err
+	}
+	plaintext, err := open(dataAEAD, ciphertext, nil)
+	if err != nil {
+		return "", false, fmt.Errorf("Error decrypting secret: %s", err)
+	}
+	return string(plaintext), keyID != k.primaryID, nil
+}
+
+// encryptSecret encrypts a secret with the primary key. Without a keyring, it's left in plaintext.
+func encryptSecret(keyring *Keyring, value string) (string, error) {
+	if keyring == nil || value == "" {
+		return value, nil
+	}
+	return keyring.Encrypt(value)
+}
+
+// decryptSecret decrypts a secret that encryptSecret encrypted, passing plaintext through. Also
+// returns whether it's stale, and should be encrypted again with the primary key.
+func decryptSecret(keyring *Keyring, value string) (string, bool, error) {
+	if !isEncrypted(value) {
+		return value, keyring != nil && value != "", nil
+	}
+	if keyring == nil {
+		return "", false, fmt.Errorf("Secret is encrypted, but no encryption keys were given")
+	}
+	return keyring.Decrypt(value)
+}
+
+// isEncrypted returns whether a value was encrypted by a Keyring
+func isEncrypted(value string) bool {
+	return strings.HasPrefix(value, encryptedPrefix)
+}
+
+// splitEncrypted splits an encrypted value into its key ID, wrapped data key, and ciphertext
+func splitEncrypted(value string) (string, []byte, []byte, error) {
+	parts := strings.Split(strings.TrimPrefix(value, encryptedPrefix), ":")
+	if !isEncrypted(value) || len(parts) != 3 {
+		return "", nil, nil, fmt.Errorf("Secret isn't in the expected format")
+	}
+	wrappedKey, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("Secret isn't in the expected format: %s", err)
+	}
+	ciphertext, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("Secret isn't in the expected format: %s", err)
+	}
+	return parts[0], wrappedKey, ciphertext, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// runEncryptionCommand handles "apocalypse encryption ...", which generates keys, and re-encrypts
+// the data file and its backups with the primary key. Returns the exit code.
+func runEncryptionCommand(args []string) int {
+	flags := flag.NewFlagSet("encryption", flag.ExitOnError)
+	dataFilePath := flags.String("data-file-path", "", "Location of the JSON DB file")
+	keyFilePath := flags.String("encryption-key-file", "", "File with the encryption keys, one per line - the first is the primary key")
+	keyID := flags.String("id", "1", "ID of the generated key")
+	flags.Usage = func() {
+		fmt.Println("apocalypse2016 encryption usage:")
+		fmt.Println("  apocalypse encryption [-id <id>] generate-key")
+		fmt.Println("  apocalypse encryption -data-file-path <path> [-encryption-key-file <path>] reencrypt")
+		flags.PrintDefaults()
+		fmt.Println("\nWithout -encryption-key-file, keys are read from the ENCRYPTION_KEYS environment variable.")
+		fmt.Println("To rotate keys, put a new key first, keep the old ones after it, and re-encrypt. Stop the bot first.")
+	}
+	flags.Parse(args)
+
+	switch flags.Arg(0) {
+	case "generate-key":
+		key, err := generateKey(*keyID)
+		if err != nil {
+			fmt.Printf("Error generating key: %s\n", err)
+			return -1
+		}
+		fmt.Println(key)
+		return 0
+	case "reencrypt":
+	default:
+		flags.Usage()
+		return -1
+	}
+
+	keyring, err := LoadKeyring(*keyFilePath, os.Getenv("ENCRYPTION_KEYS"))
+	if err != nil || keyring == nil || *dataFilePath == "" {
+		if err != nil {
+			fmt.Printf("Invalid encryption keys: %s\n\n", err)
+		}
+		flags.Usage()
+		return -1
+	}
+	store := NewEncryptedStore(NewFileStore(*dataFilePath, defaultBackupPolicy), keyring)
+
+	// loading the data file re-encrypts it, if it needs it
+	if _, err := store.Load(); err != nil {
+		fmt.Printf("Error: %s\n", err)
+		return -1
+	}
+
+	backups, err := listBackups(*dataFilePath)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		return -1
+	}
+	failed := 0
+	for _, backup := range backups {
+		count, err := store.reencryptBackup(*dataFilePath, backup)
+		if err != nil {
+			fmt.Printf("%s: %s\n", backup.ID(), err)
+			failed++
+		} else if count > 0 {
+			fmt.Printf("%s: re-encrypted %d secrets\n", backup.ID(), count)
+		}
+	}
+	if failed > 0 {
+		return -1
+	}
+	fmt.Println("Done")
+	return 0
+}
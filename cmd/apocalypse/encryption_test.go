@@ -0,0 +1,237 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// newTestKeyring returns a keyring of new random keys, the first being the primary key
+func newTestKeyring(t *testing.T, ids ...string) (*Keyring, []string) {
+	keys := []string{}
+	for _, id := range ids {
+		key, err := generateKey(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	keyring, err := ParseKeyring(strings.Join(keys, ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring, keys
+}
+
+func TestParseKeyring(t *testing.T) {
+	key, err := generateKey("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := generateKey("k2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		text      string
+		primaryID string // empty if it should fail
+	}{
+		{"one key", key, "k1"},
+		{"first key is primary", otherKey + "," + key, "k2"},
+		{"newlines and comments", "# rotated in June\n" + otherKey + "\n\n" + key + "\n", "k2"},
+		{"no keys", "# nothing here\n", ""},
+		{"no ID", ":" + strings.SplitN(key, ":", 2)[1], ""},
+		{"no separator", "k1", ""},
+		{"not base64", "k1:not base64!", ""},
+		{"wrong length", "k1:c2hvcnQ=", ""},
+		{"same ID twice", key + "," + key, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keyring, err := ParseKeyring(test.text)
+			if test.primaryID == "" {
+				if err == nil {
+					t.Errorf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error: %s", err)
+			}
+			if keyring.primaryID != test.primaryID {
+				t.Errorf("got primary key %s, expected %s", keyring.primaryID, test.primaryID)
+			}
+		})
+	}
+}
+
+func TestKeyringRoundTrip(t *testing.T) {
+	keyring, _ := newTestKeyring(t, "k1")
+
+	for _, plaintext := range []string{testBotToken, testWebhookURL, "", "ünïcødé"} {
+		encrypted, err := keyring.Encrypt(plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isEncrypted(encrypted) || !strings.HasPrefix(encrypted, encryptedPrefix+"k1:") {
+			t.Errorf("%q doesn't look encrypted with k1", encrypted)
+		}
+		if plaintext != "" && strings.Contains(encrypted, plaintext) {
+			t.Errorf("%q contains the plaintext", encrypted)
+		}
+
+		decrypted, rotated, err := keyring.Decrypt(encrypted)
+		if err != nil {
+			t.Fatalf("Error decrypting %q: %s", plaintext, err)
+		}
+		if decrypted != plaintext {
+			t.Errorf("got %q, expected %q", decrypted, plaintext)
+		}
+		if rotated {
+			t.Errorf("secret encrypted with the primary key needs re-encrypting")
+		}
+	}
+
+	// each secret gets its own data key and nonce
+	first, _ := keyring.Encrypt(testBotToken)
+	second, _ := keyring.Encrypt(testBotToken)
+	if first == second {
+		t.Errorf("the same secret encrypted the same way twice")
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	oldKeyring, oldKeys := newTestKeyring(t, "old")
+	newKeyring, newKeys := newTestKeyring(t, "new")
+	rotatedKeyring, err := ParseKeyring(newKeys[0] + "," + oldKeys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := oldKeyring.Encrypt(testUserToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, rotated, err := rotatedKeyring.Decrypt(encrypted)
+	if err != nil {
+		t.Fatalf("Error decrypting with the old key: %s", err)
+	}
+	if decrypted != testUserToken || !rotated {
+		t.Errorf("got %q, rotated %t - expected %q, rotated", decrypted, rotated, testUserToken)
+	}
+
+	// re-encrypted with the new primary key, it no longer needs the old one
+	reencrypted, err := rotatedKeyring.Encrypt(decrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(reencrypted, encryptedPrefix+"new:") {
+		t.Errorf("%q wasn't encrypted with the new key", reencrypted)
+	}
+	if decrypted, rotated, err = newKeyring.Decrypt(reencrypted); err != nil || decrypted != testUserToken || rotated {
+		t.Errorf("got %q, rotated %t, error %v from the new key alone", decrypted, rotated, err)
+	}
+	if _, _, err := oldKeyring.Decrypt(reencrypted); err == nil {
+		t.Errorf("old key decrypted a secret encrypted with the new one")
+	}
+}
+
+func TestKeyringWrongKey(t *testing.T) {
+	keyring, _ := newTestKeyring(t, "k1")
+	encrypted, err := keyring.Encrypt(testBotToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a different key with the same ID
+	sameID, _ := newTestKeyring(t, "k1")
+	if _, _, err := sameID.Decrypt(encrypted); err == nil {
+		t.Errorf("decrypted with the wrong key")
+	}
+
+	// a keyring without the key
+	otherID, _ := newTestKeyring(t, "k2")
+	if _, _, err := otherID.Decrypt(encrypted); err == nil || !strings.Contains(err.Error(), "unknown key k1") {
+		t.Errorf("got error %v, expected an unknown key", err)
+	}
+
+	// no keyring at all
+	if _, _, err := decryptSecret(nil, encrypted); err == nil {
+		t.Errorf("decrypted without any keys")
+	}
+}
+
+func TestKeyringTamperedCiphertext(t *testing.T) {
+	// k2 is in the keyring too, so changing the key ID still finds a key
+	keyring, _ := newTestKeyring(t, "k1", "k2")
+	encrypted, err := keyring.Encrypt(testBotToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(strings.TrimPrefix(encrypted, encryptedPrefix), ":")
+
+	// changes a character in the middle of a base64 value to another valid one - the last might only
+	// hold padding bits
+	flip := func(value string) string {
+		middle := len(value) / 2
+		replacement := "A"
+		if value[middle] == 'A' {
+			replacement = "B"
+		}
+		return value[:middle] + replacement + value[middle+1:]
+	}
+
+	otherEncrypted, err := keyring.Encrypt(testUserToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherParts := strings.Split(strings.TrimPrefix(otherEncrypted, encryptedPrefix), ":")
+
+	tests := map[string]string{
+		"ciphertext":              encryptedPrefix + parts[0] + ":" + parts[1] + ":" + flip(parts[2]),
+		"wrapped key":             encryptedPrefix + parts[0] + ":" + flip(parts[1]) + ":" + parts[2],
+		"key ID":                  encryptedPrefix + "k2:" + parts[1] + ":" + parts[2],
+		"swapped ciphertext":      encryptedPrefix + parts[0] + ":" + parts[1] + ":" + otherParts[2],
+		"truncated ciphertext":    encryptedPrefix + parts[0] + ":" + parts[1] + ":" + parts[2][:8],
+		"missing part":            encryptedPrefix + parts[0] + ":" + parts[1],
+		"not base64":              encryptedPrefix + parts[0] + ":" + parts[1] + ":!!!",
+		"not encrypted at all":    testBotToken,
+		"empty":                   "",
+		"prefix and nothing else": encryptedPrefix,
+	}
+	for name, tampered := range tests {
+		t.Run(name, func(t *testing.T) {
+			if plaintext, _, err := keyring.Decrypt(tampered); err == nil {
+				t.Errorf("decrypted %q to %q", tampered, plaintext)
+			}
+		})
+	}
+}
+
+func TestSecretHelpers(t *testing.T) {
+	keyring, _ := newTestKeyring(t, "k1")
+
+	// without a keyring, secrets stay in plaintext, and aren't stale
+	if value, err := encryptSecret(nil, testBotToken); err != nil || value != testBotToken {
+		t.Errorf("got %q, %v without a keyring", value, err)
+	}
+	if value, stale, err := decryptSecret(nil, testBotToken); err != nil || value != testBotToken || stale {
+		t.Errorf("got %q, stale %t, %v without a keyring", value, stale, err)
+	}
+
+	// with one, plaintext secrets are stale, but empty ones aren't encrypted
+	if value, stale, err := decryptSecret(keyring, testBotToken); err != nil || value != testBotToken || !stale {
+		t.Errorf("got %q, stale %t, %v for a plaintext secret", value, stale, err)
+	}
+	if value, err := encryptSecret(keyring, ""); err != nil || value != "" {
+		t.Errorf("got %q, %v for an empty secret", value, err)
+	}
+	encrypted, err := encryptSecret(keyring, testBotToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, stale, err := decryptSecret(keyring, encrypted); err != nil || value != testBotToken || stale {
+		t.Errorf("got %q, stale %t, %v for an encrypted secret", value, stale, err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+)
+
+// handleEvents handles requests from the Slack Events API. We only care about
+// being uninstalled, or having our tokens revoked, so we stop posting to dead webhooks.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	logFields := log.Fields{
+		"request": "/events",
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.WithFields(logFields).Errorf("Error reading body: %s", err)
+		http.Error(w, "error", http.StatusBadRequest)
+		return
+	}
+
+	callback := SlackEventCallback{}
+	if err := json.Unmarshal(body, &callback); err != nil {
+		log.WithFields(logFields).Errorf("Error unmarshalling event: %s", err)
+		http.Error(w, "error", http.StatusBadRequest)
+		return
+	}
+	logFields["type"] = callback.Type
+	logFields["teamID"] = callback.TeamID
+	logFields["eventID"] = callback.EventID
+	logFields["event"] = callback.Event.Type
+
+	switch callback.Type {
+	case "url_verification":
+		log.WithFields(logFields).Infof("Answering Events API URL verification")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(callback.Challenge))
+		return
+	case "event_callback":
+	default:
+		log.WithFields(logFields).Debugf("Ignoring unknown event callback type")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var removed int
+	switch callback.Event.Type {
+	case "app_uninstalled":
+		removed = s.removeAccounts(func(account *Account) bool {
+			return account.TeamID == callback.TeamID
+		})
+	case "tokens_revoked":
+		revokedUsers := make(map[string]bool)
+		for _, userID := range callback.Event.Tokens.OAuth {
+			revokedUsers[userID] = true
+		}
+		revokedBots := make(map[string]bool)
+		for _, botID := range callback.Event.Tokens.Bot {
+			revokedBots[botID] = true
+		}
+		removed = s.removeAccounts(func(account *Account) bool {
+			return account.TeamID == callback.TeamID &&
+				(revokedUsers[account.UserID] || (account.Bot.UserID != "" && revokedBots[account.Bot.UserID]))
+		})
+	default:
+		log.WithFields(logFields).Debugf("Ignoring event")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	logFields["removed"] = removed
+	log.WithFields(logFields).Infof("Removed accounts")
+	w.WriteHeader(http.StatusOK)
+}
+
+// removeAccounts removes every account that matches, and saves. Returns how many were removed.
+func (s *Server) removeAccounts(matches func(account *Account) bool) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	removed := 0
+	for key, account := range s.serverState.Tokens {
+		if matches(account) {
+			delete(s.serverState.Tokens, key)
+			removed++
+		}
+	}
+
+	if removed > 0 {
+		if err := s.saveServerData(); err != nil {
+			log.WithFields(log.Fields{
+				"area": "db",
+			}).Errorf("Error saving token data: %s", err)
+		}
+	}
+	return removed
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// FileStore stores the server state as a JSON file, backing it up before each save
+type FileStore struct {
+	filePath     string
+	backupPolicy BackupPolicy // which backups to keep
+}
+
+// NewFileStore returns a new FileStore
+func NewFileStore(filePath string, backupPolicy BackupPolicy) *FileStore {
+	return &FileStore{
+		filePath:     filePath,
+		backupPolicy: backupPolicy,
+	}
+}
+
+// Load reads the JSON file. A missing file is an empty state, but a file that can't be parsed is an error.
+func (f *FileStore) Load() (*ServerState, error) {
+	serverState := &ServerState{}
+
+	data, err := ioutil.ReadFile(f.filePath)
+	if os.IsNotExist(err) {
+		log.WithFields(log.Fields{
+			"area": "db",
+			"file": f.filePath,
+		}).Warnf("No data file yet - starting with no accounts")
+		return serverState, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Error reading data file: %s", err)
+	}
+
+	if err := json.Unmarshal(data, serverState); err != nil {
+		return nil, fmt.Errorf("Error parsing data file %s - restore it from a backup, or move it out of the way to start with no accounts: %s", f.filePath, err)
+	}
+	return serverState, nil
+}
+
+// Save backs up the JSON file, then replaces it
+func (f *FileStore) Save(serverState *ServerState) error {
+	return f.save(serverState, true)
+}
+
+// save replaces the JSON file, backing it up first if asked to
+func (f *FileStore) save(serverState *ServerState, backUp bool) error {
+	jsonData, err := json.Marshal(serverState)
+	if err != nil {
+		return fmt.Errorf("Error marshalling server data: %s", err)
+	}
+
+	if backUp {
+		now := time.Now()
+		if err := writeBackup(f.filePath, now); err != nil {
+			// allow this error
+			log.WithFields(log.Fields{
+				"area": "db",
+			}).Errorf("Could not back up data file: %s", err)
+		} else if err := rotateBackups(f.filePath, f.backupPolicy, now); err != nil {
+			// allow this error
+			log.WithFields(log.Fields{
+				"area": "db",
+			}).Errorf("Could not rotate data file backups: %s", err)
+		}
+	}
+
+	if err := writeFileSynced(f.filePath, jsonData, 0644); err != nil {
+		return fmt.Errorf("Error writing data to file: %s", err)
+	}
+	return nil
+}
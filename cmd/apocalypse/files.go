@@ -1,33 +1,42 @@
 package main
 
 import (
-	"io"
 	"os"
+	"path/filepath"
 )
 
-// copyFileContents copies the contents of the file named src to the file named
-// by dst. The file will be created if it does not already exist. If the
-// destination file exists, all it's contents will be replaced by the contents
-// of the source file.
-func copyFileContents(src string, dst string) (err error) {
-	in, err := os.Open(src)
+// writeFileSynced writes data to a temp file next to filePath, syncs it to disk, then renames it into
+// place, so filePath holds either its old contents or all of the new ones - never part of them
+func writeFileSynced(filePath string, data []byte, perm os.FileMode) error {
+	tempPath := filePath + ".tmp"
+	tempFile, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
 	if err != nil {
-		return
+		return err
 	}
-	defer in.Close()
-	out, err := os.Create(dst)
-	if err != nil {
-		return
+	if _, err := tempFile.Write(data); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Sync(); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, filePath); err != nil {
+		return err
 	}
-	defer func() {
-		cerr := out.Close()
-		if err == nil {
-			err = cerr
-		}
-	}()
-	if _, err = io.Copy(out, in); err != nil {
-		return
+
+	return syncDir(filePath)
+}
+
+// syncDir makes sure a rename to filePath is on disk, by syncing the directory it's in
+func syncDir(filePath string) error {
+	dir, err := os.Open(filepath.Dir(filePath))
+	if err != nil {
+		return err
 	}
-	err = out.Sync()
-	return
+	defer dir.Close()
+	return dir.Sync()
 }
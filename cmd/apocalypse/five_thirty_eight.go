@@ -3,23 +3,165 @@ package main
 import (
 	"fmt"
 	"github.com/PuerkitoBio/goquery"
+	log "github.com/Sirupsen/logrus"
 	"strconv"
 	"strings"
+	"time"
 )
 
-// FetchTrumpChance fetches the chance that Trump will win the election
-func fetchTrumpChance() (float32, error) {
-	doc, err := goquery.NewDocument("http://projects.fivethirtyeight.com/2016-election-forecast")
+var (
+	// 538's model names, mapped to the IDs their page uses for them
+	_fiveThirtyEightModels = []struct {
+		name string
+		id   string
+	}{
+		{"polls-only", "polls"},
+		{"polls-plus", "plus"},
+		{"now-cast", "now"},
+	}
+)
+
+// FiveThirtyEight scrapes FiveThirtyEight's 2016 election forecast page.
+type FiveThirtyEight struct {
+	pageURL string // page to scrape
+}
+
+// NewFiveThirtyEight returns a new FiveThirtyEight forecast source
+func NewFiveThirtyEight() *FiveThirtyEight {
+	return &FiveThirtyEight{
+		pageURL: "http://projects.fivethirtyeight.com/2016-election-forecast",
+	}
+}
+
+// Name returns the name of this source
+func (f *FiveThirtyEight) Name() string {
+	return "538"
+}
+
+// URL returns the attribution link for this source
+func (f *FiveThirtyEight) URL() string {
+	return "https://projects.fivethirtyeight.com/2016-election-forecast"
+}
+
+// Models returns the names of 538's models, with the page's default first
+func (f *FiveThirtyEight) Models() []string {
+	models := []string{}
+	for _, model := range _fiveThirtyEightModels {
+		models = append(models, model.name)
+	}
+	return models
+}
+
+// Fetch fetches the chance that Trump will win the election, for each model on the page
+func (f *FiveThirtyEight) Fetch() (*Forecast, error) {
+	doc, err := goquery.NewDocument(f.pageURL)
 	if err != nil {
-		return 0, fmt.Errorf("Error fetching document: %s", err)
+		return nil, fmt.Errorf("Error fetching document: %s", err)
 	}
 
-	percentStr := doc.Find("[data-card-id='US-winprob-sentence'] .candidate-val.winprob[data-key='winprob'][data-party='R']").Text()
+	forecast := &Forecast{
+		Source:    f.Name(),
+		URL:       f.URL(),
+		Models:    make(map[string]*ModelForecast),
+		FetchedAt: time.Now(),
+	}
+
+	// each model's cards are rendered in their own container - one that can't be read doesn't
+	// stop us reporting the others
+	containers := 0
+	var lastErr error
+	for _, model := range _fiveThirtyEightModels {
+		container := doc.Find(fmt.Sprintf("[data-model='%s']", model.id))
+		if container.Find("[data-card-id='US-winprob-sentence']").Length() == 0 {
+			continue
+		}
+		containers++
+		modelForecast, err := parseFiveThirtyEightModel(container)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"area":  "fetch",
+				"model": model.name,
+			}).Errorf("Error reading model - skipping it: %s", err)
+			lastErr = fmt.Errorf("Error reading %s model: %s", model.name, err)
+			continue
+		}
+		forecast.Models[model.name] = modelForecast
+	}
+	if containers > 0 && len(forecast.Models) == 0 {
+		return nil, lastErr
+	}
+
+	// if the page doesn't break out its models, it's only showing the default
+	if containers == 0 {
+		modelForecast, err := parseFiveThirtyEightModel(doc.Selection)
+		if err != nil {
+			return nil, err
+		}
+		forecast.Models[_fiveThirtyEightModels[0].name] = modelForecast
+	}
+
+	return forecast, nil
+}
+
+// parseFiveThirtyEightModel reads the national and state cards of one model. Cards are
+// identified by "<area>-winprob-sentence", where area is "US" or a state code.
+func parseFiveThirtyEightModel(container *goquery.Selection) (*ModelForecast, error) {
+	trumpChance, err := parseWinProb(container.Find("[data-card-id='US-winprob-sentence']"), "R")
+	if err != nil {
+		return nil, err
+	}
+
+	modelForecast := &ModelForecast{
+		TrumpChance:    trumpChance,
+		States:         make(map[string]float32),
+		ElectoralVotes: parseCandidateVals(container.Find("[data-card-id='US-ev-sentence']"), "ev"),
+		PopularVote:    parseCandidateVals(container.Find("[data-card-id='US-popvote-sentence']"), "popvote"),
+	}
+	container.Find("[data-card-id$='-winprob-sentence']").Each(func(i int, card *goquery.Selection) {
+		cardID, _ := card.Attr("data-card-id")
+		state, ok := normalizeState(strings.TrimSuffix(cardID, "-winprob-sentence"))
+		if !ok {
+			return
+		}
+		// a state we can't read just isn't reported this time around
+		if val, err := parseWinProb(card, "R"); err == nil {
+			modelForecast.States[state] = val
+		}
+	})
+	return modelForecast, nil
+}
+
+// parseWinProb reads a party's win probability from a card
+func parseWinProb(card *goquery.Selection, party string) (float32, error) {
+	percentStr := card.Find(fmt.Sprintf(".candidate-val.winprob[data-key='winprob'][data-party='%s']", party)).First().Text()
+	return parsePercent(percentStr)
+}
+
+// parsePercent parses a string like "33.4%"
+func parsePercent(percentStr string) (float32, error) {
+	percentStr = strings.TrimSpace(percentStr)
 	if !strings.HasSuffix(percentStr, "%") {
 		return 0, fmt.Errorf("Error finding percentage")
 	}
 
 	percentStr = strings.TrimSuffix(percentStr, "%")
 	val, err := strconv.ParseFloat(percentStr, 32)
-	return float32(val), err
+	if err != nil {
+		return 0, fmt.Errorf("Error parsing percentage: %s", err)
+	}
+	return float32(val), nil
+}
+
+// parseCandidateVals reads each candidate's value of a projection from a card, like
+// electoral votes ("197.4") or popular vote ("44.1%"). Candidates without a value are left out.
+func parseCandidateVals(card *goquery.Selection, key string) map[string]float32 {
+	vals := make(map[string]float32)
+	for _, candidate := range _candidates {
+		valStr := card.Find(fmt.Sprintf(".candidate-val[data-key='%s'][data-party='%s']", key, candidate.party)).First().Text()
+		valStr = strings.TrimSuffix(strings.TrimSpace(valStr), "%")
+		if val, err := strconv.ParseFloat(valStr, 32); err == nil {
+			vals[candidate.party] = float32(val)
+		}
+	}
+	return vals
 }
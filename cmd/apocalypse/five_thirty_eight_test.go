@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fiveThirtyEightCard returns a model's national win probability card, as 538's page renders it
+func fiveThirtyEightCard(modelID, trumpChance string) string {
+	return fmt.Sprintf(`<div data-model="%s"><div data-card-id="US-winprob-sentence">`+
+		`<span class="candidate-val winprob" data-key="winprob" data-party="R">%s</span></div></div>`, modelID, trumpChance)
+}
+
+// fetchTestPage fetches a forecast from a page served with the given body
+func fetchTestPage(t *testing.T, body string) (*Forecast, error) {
+	page := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "<html><body>%s</body></html>", body)
+	}))
+	defer page.Close()
+
+	source := NewFiveThirtyEight()
+	source.pageURL = page.URL
+	return source.Fetch()
+}
+
+func TestFiveThirtyEightSkipsUnreadableModel(t *testing.T) {
+	var forecast *Forecast
+	var err error
+	output := captureLogs(t, func() {
+		forecast, err = fetchTestPage(t, fiveThirtyEightCard("polls", "12.5%")+
+			fiveThirtyEightCard("plus", "not a number")+
+			fiveThirtyEightCard("now", "20.1%"))
+	})
+	if err != nil {
+		t.Fatalf("one unreadable model stopped the others being read: %s", err)
+	}
+	if len(forecast.Models) != 2 || forecast.Models["polls-only"] == nil || forecast.Models["now-cast"] == nil {
+		t.Fatalf("got models %v", forecast.Models)
+	}
+	if chance := forecast.Models["now-cast"].TrumpChance; chance != 20.1 {
+		t.Errorf("got now-cast chance %v", chance)
+	}
+	if !strings.Contains(output, "polls-plus") {
+		t.Errorf("unreadable model wasn't logged:\n%s", output)
+	}
+}
+
+func TestFiveThirtyEightNoReadableModels(t *testing.T) {
+	var err error
+	captureLogs(t, func() {
+		_, err = fetchTestPage(t, fiveThirtyEightCard("polls", "?")+fiveThirtyEightCard("plus", "?"))
+	})
+	if err == nil {
+		t.Errorf("expected an error when no model could be read")
+	}
+
+	// a page without per-model containers is read as the default model
+	forecast, err := fetchTestPage(t, `<div data-card-id="US-winprob-sentence">`+
+		`<span class="candidate-val winprob" data-key="winprob" data-party="R">33.4%</span></div>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if model := forecast.Models["polls-only"]; model == nil || model.TrumpChance != 33.4 {
+		t.Errorf("got models %v", forecast.Models)
+	}
+}
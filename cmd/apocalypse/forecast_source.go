@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ForecastSource is a website or service that publishes a forecast of Trump's chance of winning.
+type ForecastSource interface {
+	Name() string              // short, unique name of the source, used in configuration and the DB
+	URL() string               // attribution link included in every message
+	Models() []string          // names of the models this source publishes - the first is the default
+	Fetch() (*Forecast, error) // fetch the current forecast
+}
+
+// Forecast is a snapshot of a source's prediction, for each of its models.
+type Forecast struct {
+	Source    string                    `json:"source"`
+	URL       string                    `json:"url"`
+	Models    map[string]*ModelForecast `json:"models"` // by model name
+	FetchedAt time.Time                 `json:"fetched_at"`
+}
+
+// ModelForecast holds the values a single forecast model predicts.
+type ModelForecast struct {
+	TrumpChance    float32            `json:"trump_chance"`
+	States         map[string]float32 `json:"states,omitempty"`          // Trump's chance of winning each state, by state code
+	ElectoralVotes map[string]float32 `json:"electoral_votes,omitempty"` // projected electoral votes, by party
+	PopularVote    map[string]float32 `json:"popular_vote,omitempty"`    // projected share of the popular vote, by party
+}
+
+var (
+	// candidates we report projections for, by party, in the order they're reported
+	_candidates = []struct {
+		party string
+		name  string
+	}{
+		{"R", "Trump"},
+		{"D", "Clinton"},
+		{"L", "Johnson"},
+	}
+
+	// all known forecast sources, by name
+	_forecastSources = map[string]func() ForecastSource{
+		"538": func() ForecastSource { return NewFiveThirtyEight() },
+	}
+)
+
+// newForecastSources instantiates the forecast sources named in the comma-separated list
+func newForecastSources(names string) ([]ForecastSource, error) {
+	sources := []ForecastSource{}
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		newSource, ok := _forecastSources[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown forecast source: %s", name)
+		}
+		seen[name] = true
+		sources = append(sources, newSource())
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("No forecast sources configured")
+	}
+	return sources, nil
+}
+
+// forecastSourceNames returns the names of all known forecast sources
+func forecastSourceNames() []string {
+	names := []string{}
+	for name := range _forecastSources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// seriesKey identifies one model of one forecast source, ex: "538/polls-only"
+func seriesKey(source string, model string) string {
+	return source + "/" + model
+}
+
+// splitSeriesKey is the inverse of seriesKey
+func splitSeriesKey(key string) (source string, model string) {
+	parts := strings.SplitN(key, "/", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// stateSeriesKey identifies one state's chance in a series, ex: "538/polls-only/PA"
+func stateSeriesKey(key string, state string) string {
+	return key + "/" + state
+}
+
+// projectionKey identifies one candidate's projection in a series, ex: "538/polls-only/ev/R"
+func projectionKey(key string, metric string, party string) string {
+	return key + "/" + metric + "/" + party
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// history metrics - state chances are "winprob/<state>", and projections are "<metric>/<party>"
+const (
+	metricWinProb     = "winprob"
+	metricElectoral   = "ev"
+	metricPopularVote = "popvote"
+)
+
+// HistoryPoint is the value of one forecast metric at a point in time.
+type HistoryPoint struct {
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+	Model  string    `json:"model"`
+	Metric string    `json:"metric"`
+	Value  float32   `json:"value"`
+}
+
+// History is an append-only log of every forecast value we've fetched. All of the points are kept
+// in memory, and stored by a HistoryStore. Only changes are recorded - a series keeps its value until
+// its next point.
+type History struct {
+	store     HistoryStore
+	retention time.Duration // points older than this are dropped on compaction - 0 to keep everything
+	mutex     sync.RWMutex
+	points    []HistoryPoint     // every point, oldest first
+	latest    map[string]float32 // most recent value of each series, by historySeriesKey
+}
+
+// OpenHistory loads the history from its store
+func OpenHistory(store HistoryStore, retention time.Duration) (*History, error) {
+	points, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+
+	h := &History{
+		store:     store,
+		retention: retention,
+		points:    points,
+		latest:    make(map[string]float32),
+	}
+	for _, point := range points {
+		h.latest[historySeriesKey(point.Source, point.Model, point.Metric)] = point.Value
+	}
+	return h, nil
+}
+
+// Append records the points whose values changed since their series' last point
+func (h *History) Append(points []HistoryPoint) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	changed := []HistoryPoint{}
+	latest := make(map[string]float32)
+	for _, point := range points {
+		key := historySeriesKey(point.Source, point.Model, point.Metric)
+		previous, ok := latest[key]
+		if !ok {
+			previous, ok = h.latest[key]
+		}
+		if ok && previous == point.Value {
+			continue
+		}
+		changed = append(changed, point)
+		latest[key] = point.Value
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	if err := h.store.Append(changed); err != nil {
+		return err
+	}
+	h.points = append(h.points, changed...)
+	for key, value := range latest {
+		h.latest[key] = value
+	}
+	return nil
+}
+
+// Query returns the points of one series since the given time, oldest first. The point in effect
+// at 'since' is included, so the series' value is known for the whole window.
+func (h *History) Query(source string, model string, metric string, since time.Time) []HistoryPoint {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	points := []HistoryPoint{}
+	for _, point := range h.points {
+		if point.Source != source || point.Model != model || point.Metric != metric {
+			continue
+		}
+		if point.Time.Before(since) {
+			// keep only the latest point before the window
+			points = append(points[:0], point)
+			continue
+		}
+		points = append(points, point)
+	}
+	return points
+}
+
+// LatestTime returns the time of the most recent point of a series
+func (h *History) LatestTime(source string, model string, metric string) (time.Time, bool) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	for i := len(h.points) - 1; i >= 0; i-- {
+		point := h.points[i]
+		if point.Source == source && point.Model == model && point.Metric == metric {
+			return point.Time, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Compact drops points older than the retention period, and thins points older than a week to
+// the last one of each hour, then replaces the stored history. The last point of each series before
+// the retention period is kept, moved up to its start, since that's the series' value from then on.
+func (h *History) Compact() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	now := time.Now()
+	thinBefore := now.Add(-7 * 24 * time.Hour)
+	dropBefore := now.Add(-h.retention)
+
+	// walk backwards, so the last point of each hour is the one kept
+	kept := []HistoryPoint{}
+	seenHours := make(map[string]bool)
+	seenExpired := make(map[string]bool)
+	for i := len(h.points) - 1; i >= 0; i-- {
+		point := h.points[i]
+		if h.retention > 0 && point.Time.Before(dropBefore) {
+			key := historySeriesKey(point.Source, point.Model, point.Metric)
+			if !seenExpired[key] {
+				seenExpired[key] = true
+				point.Time = dropBefore
+				kept = append(kept, point)
+			}
+			continue
+		}
+		if point.Time.Before(thinBefore) {
+			hourKey := historySeriesKey(point.Source, point.Model, point.Metric) + "@" + strconv.FormatInt(point.Time.Unix()/3600, 10)
+			if seenHours[hourKey] {
+				continue
+			}
+			seenHours[hourKey] = true
+		}
+		kept = append(kept, point)
+	}
+	for i, j := 0, len(kept)-1; i < j; i, j = i+1, j-1 {
+		kept[i], kept[j] = kept[j], kept[i]
+	}
+
+	if err := h.store.Replace(kept); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"area":   "history",
+		"before": len(h.points),
+		"after":  len(kept),
+	}).Infof("Compacted history")
+	h.points = kept
+	return nil
+}
+
+// Close closes the history's store
+func (h *History) Close() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.store.Close()
+}
+
+// historySeriesKey identifies a series of points in the history
+func historySeriesKey(source string, model string, metric string) string {
+	return seriesKey(source, model) + "/" + metric
+}
+
+// forecastHistoryPoints breaks a forecast into a point for every value it holds
+func forecastHistoryPoints(forecast *Forecast) []HistoryPoint {
+	points := []HistoryPoint{}
+	add := func(model string, metric string, value float32) {
+		points = append(points, HistoryPoint{
+			Time:   forecast.FetchedAt,
+			Source: forecast.Source,
+			Model:  model,
+			Metric: metric,
+			Value:  value,
+		})
+	}
+	for model, modelForecast := range forecast.Models {
+		add(model, metricWinProb, modelForecast.TrumpChance)
+		for state, value := range modelForecast.States {
+			add(model, metricWinProb+"/"+state, value)
+		}
+		for party, value := range modelForecast.ElectoralVotes {
+			add(model, metricElectoral+"/"+party, value)
+		}
+		for party, value := range modelForecast.PopularVote {
+			add(model, metricPopularVote+"/"+party, value)
+		}
+	}
+	return points
+}
+
+// parseWindow parses a window of time to look back over, like "1d", "7d", "12h", or "all" (returned as 0)
+func parseWindow(window string) (time.Duration, error) {
+	window = strings.ToLower(strings.TrimSpace(window))
+	if window == "all" {
+		return 0, nil
+	}
+	if strings.HasSuffix(window, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(window, "d"))
+		if err != nil || days <= 0 {
+			return 0, fmt.Errorf("Invalid number of days: %s", window)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	duration, err := time.ParseDuration(window)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("Invalid window: %s", window)
+	}
+	return duration, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"os"
+)
+
+// FileHistoryStore stores forecast history in a file, one JSON point per line
+type FileHistoryStore struct {
+	filePath string
+	file     *os.File // opened for appending
+}
+
+// OpenFileHistoryStore opens the history file, creating it if needed
+func OpenFileHistoryStore(filePath string) (*FileHistoryStore, error) {
+	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening history file: %s", err)
+	}
+	return &FileHistoryStore{
+		filePath: filePath,
+		file:     file,
+	}, nil
+}
+
+// Load reads every point from the history file
+func (f *FileHistoryStore) Load() ([]HistoryPoint, error) {
+	return readHistoryFile(f.filePath)
+}
+
+// readHistoryFile reads every point from a history file. A missing file has no points.
+func readHistoryFile(filePath string) ([]HistoryPoint, error) {
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Error opening history file: %s", err)
+	}
+	defer file.Close()
+
+	points := []HistoryPoint{}
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		point := HistoryPoint{}
+		if err := json.Unmarshal(scanner.Bytes(), &point); err != nil {
+			// a partially-written last line is expected after a crash
+			log.WithFields(log.Fields{
+				"area": "history",
+				"line": lineNum,
+			}).Warnf("Skipping unreadable history point: %s", err)
+			continue
+		}
+		points = append(points, point)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading history file: %s", err)
+	}
+	return points, nil
+}
+
+// Append adds points to the end of the history file
+func (f *FileHistoryStore) Append(points []HistoryPoint) error {
+	data := []byte{}
+	for _, point := range points {
+		jsonData, err := json.Marshal(point)
+		if err != nil {
+			return fmt.Errorf("Error marshalling history point: %s", err)
+		}
+		data = append(append(data, jsonData...), '\n')
+	}
+	if _, err := f.file.Write(data); err != nil {
+		return fmt.Errorf("Error writing history points: %s", err)
+	}
+	return nil
+}
+
+// Replace rewrites the history file with just the given points
+func (f *FileHistoryStore) Replace(points []HistoryPoint) error {
+	// write to a temp file, then swap it in
+	tempPath := f.filePath + ".tmp"
+	tempFile, err := os.Create(tempPath)
+	if err != nil {
+		return fmt.Errorf("Error creating compacted history file: %s", err)
+	}
+	writer := bufio.NewWriter(tempFile)
+	encoder := json.NewEncoder(writer)
+	for _, point := range points {
+		if err := encoder.Encode(point); err != nil {
+			tempFile.Close()
+			return fmt.Errorf("Error writing compacted history: %s", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tempFile.Close()
+		return fmt.Errorf("Error writing compacted history: %s", err)
+	}
+	if err := tempFile.Sync(); err != nil {
+		tempFile.Close()
+		return fmt.Errorf("Error syncing compacted history: %s", err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("Error closing compacted history: %s", err)
+	}
+
+	// open the new file before swapping it in, so if anything fails, we're still appending to the old one
+	file, err := os.OpenFile(tempPath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("Error opening compacted history: %s", err)
+	}
+	if err := os.Rename(tempPath, f.filePath); err != nil {
+		file.Close()
+		os.Remove(tempPath)
+		return fmt.Errorf("Error replacing history file: %s", err)
+	}
+	if err := syncDir(f.filePath); err != nil {
+		log.WithFields(log.Fields{
+			"area": "history",
+		}).Errorf("Error syncing history directory: %s", err)
+	}
+	f.file.Close()
+	f.file = file
+	return nil
+}
+
+// Close closes the history file
+func (f *FileHistoryStore) Close() error {
+	return f.file.Close()
+}
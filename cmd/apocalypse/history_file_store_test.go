@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openTestHistoryStore opens a history file in a temp directory, closing it when the test's done
+func openTestHistoryStore(t *testing.T) *FileHistoryStore {
+	dir, err := ioutil.TempDir("", "apocalypse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	store, err := OpenFileHistoryStore(filepath.Join(dir, "history.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+	})
+	return store
+}
+
+// testHistoryPoints returns points with the given values, a minute apart
+func testHistoryPoints(values ...float32) []HistoryPoint {
+	start := time.Date(2016, 10, 18, 15, 4, 0, 0, time.UTC)
+	points := []HistoryPoint{}
+	for i, value := range values {
+		points = append(points, HistoryPoint{
+			Time:   start.Add(time.Duration(i) * time.Minute),
+			Source: "538",
+			Model:  "polls-only",
+			Metric: "winprob",
+			Value:  value,
+		})
+	}
+	return points
+}
+
+// assertHistoryValues fails unless a history file holds exactly these values, in order
+func assertHistoryValues(t *testing.T, filePath string, expected ...float32) {
+	points, err := readHistoryFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != len(expected) {
+		t.Fatalf("got %d points, expected %d", len(points), len(expected))
+	}
+	for i, point := range points {
+		if point.Value != expected[i] {
+			t.Errorf("got value %v at %d, expected %v", point.Value, i, expected[i])
+		}
+	}
+}
+
+func TestFileHistoryStoreReplace(t *testing.T) {
+	store := openTestHistoryStore(t)
+	if err := store.Append(testHistoryPoints(1, 2, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Replace(testHistoryPoints(1, 3)); err != nil {
+		t.Fatal(err)
+	}
+
+	// appends after replacing go to the new file
+	if err := store.Append(testHistoryPoints(4)); err != nil {
+		t.Fatal(err)
+	}
+	assertHistoryValues(t, store.filePath, 1, 3, 4)
+	if _, err := os.Stat(store.filePath + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temp file was left behind: %v", err)
+	}
+}
+
+func TestFileHistoryStoreFailedReplace(t *testing.T) {
+	store := openTestHistoryStore(t)
+	if err := store.Append(testHistoryPoints(1, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	// keep a link to the original file, then put a directory in its place, so the rename fails
+	originalPath := store.filePath + ".orig"
+	if err := os.Link(store.filePath, originalPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(store.filePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(store.filePath, "blocker"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Replace(testHistoryPoints(1)); err == nil {
+		t.Fatalf("replaced a history file that's a directory")
+	}
+	if _, err := os.Stat(store.filePath + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temp file was left behind: %v", err)
+	}
+
+	// the store's still appending to the original file
+	if err := store.Append(testHistoryPoints(3)); err != nil {
+		t.Fatalf("Error appending after a failed replace: %s", err)
+	}
+	assertHistoryValues(t, originalPath, 1, 2, 3)
+}
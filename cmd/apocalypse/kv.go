@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// the log's compacted once it holds this many more operations than there are live keys
+const kvCompactSlack = 1000
+
+// kvFrameHeaderSize is the length and checksum in front of each transaction
+const kvFrameHeaderSize = 8
+
+// errKVShortFrame is a transaction that runs past the end of the log - one that was being written
+// when we crashed, so it never committed
+var errKVShortFrame = errors.New("transaction runs past the end of the log")
+
+// KVDB is a small embedded key-value database. Every transaction is appended to a log file as one
+// checksummed frame, so after a crash a transaction is either all there or not there at all. All of
+// the keys are kept in memory, and the log's rewritten with just the live keys once it's mostly garbage.
+type KVDB struct {
+	filePath  string
+	mutex     sync.RWMutex
+	file      *os.File          // opened for appending
+	data      map[string][]byte // live keys
+	opsInFile int               // operations in the log, live or not
+	fileSize  int64             // bytes of committed transactions in the log
+}
+
+// kvOp is a put, or a delete, of one key
+type kvOp struct {
+	Key    string `json:"k"`
+	Value  []byte `json:"v,omitempty"`
+	Delete bool   `json:"d,omitempty"`
+}
+
+// KVTx is a transaction - its changes are seen by its own Gets, and by everyone else once it commits
+type KVTx struct {
+	db  *KVDB
+	ops []kvOp
+}
+
+// OpenKVDB opens the database, creating it if needed
+func OpenKVDB(filePath string) (*KVDB, error) {
+	db := &KVDB{
+		filePath: filePath,
+		data:     make(map[string][]byte),
+	}
+	if err := db.load(); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening database: %s", err)
+	}
+	db.file = file
+	return db, nil
+}
+
+// replay the log
+func (db *KVDB) load() error {
+	file, err := os.OpenFile(db.filePath, os.O_RDWR, 0600)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Error opening database: %s", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("Error opening database: %s", err)
+	}
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		ops, size, err := readKVFrame(reader, info.Size()-offset)
+		if err == io.EOF {
+			db.fileSize = offset
+			return nil
+		} else if err != nil && err != errKVShortFrame && offset+size < info.Size() {
+			// committed transactions follow it, so this isn't a torn write - don't throw them away
+			return fmt.Errorf("Error reading database: transaction at offset %d of %s is corrupt: %s", offset, db.filePath, err)
+		} else if err != nil {
+			// a transaction that was being written when we crashed - it never committed
+			log.WithFields(log.Fields{
+				"area":   "db",
+				"file":   db.filePath,
+				"offset": offset,
+				"bytes":  info.Size() - offset,
+			}).Warnf("Discarding incomplete transaction at the end of the database: %s", err)
+			if err := file.Truncate(offset); err != nil {
+				return fmt.Errorf("Error truncating database: %s", err)
+			}
+			db.fileSize = offset
+			return nil
+		}
+		db.apply(ops)
+		offset += size
+	}
+}
+
+// readKVFrame reads one transaction: its length, its checksum, then its JSON. remaining is how much of
+// the log is left to read. Returns errKVShortFrame if the transaction doesn't fit in it. Otherwise the
+// transaction's size is returned, even if it's unreadable.
+func readKVFrame(reader io.Reader, remaining int64) ([]kvOp, int64, error) {
+	header := make([]byte, kvFrameHeaderSize)
+	if _, err := io.ReadFull(reader, header); err == io.EOF {
+		return nil, 0, io.EOF
+	} else if err != nil {
+		return nil, 0, errKVShortFrame
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+
+	// check the length before trusting it with an allocation
+	size := kvFrameHeaderSize + int64(length)
+	if size > remaining {
+		return nil, 0, errKVShortFrame
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, 0, errKVShortFrame
+	}
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, size, fmt.Errorf("bad checksum")
+	}
+	ops := []kvOp{}
+	if err := json.Unmarshal(payload, &ops); err != nil {
+		return nil, size, fmt.Errorf("unreadable transaction: %s", err)
+	}
+	return ops, size, nil
+}
+
+// encodeKVFrame encodes one transaction for the log
+func encodeKVFrame(ops []kvOp) ([]byte, error) {
+	payload, err := json.Marshal(ops)
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, kvFrameHeaderSize, kvFrameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	return append(frame, payload...), nil
+}
+
+// apply operations to the live keys - lock should already be held
+func (db *KVDB) apply(ops []kvOp) {
+	for _, op := range ops {
+		if op.Delete {
+			delete(db.data, op.Key)
+		} else {
+			db.data[op.Key] = op.Value
+		}
+	}
+	db.opsInFile += len(ops)
+}
+
+// Get returns the value of a key
+func (db *KVDB) Get(key string) ([]byte, bool) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	value, ok := db.data[key]
+	return value, ok
+}
+
+// Keys returns every key with a prefix, sorted
+func (db *KVDB) Keys(prefix string) []string {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return db.keys(prefix, nil)
+}
+
+// keys returns every key with a prefix, sorted, with a transaction's operations applied - lock should
+// already be held
+func (db *KVDB) keys(prefix string, ops []kvOp) []string {
+	found := make(map[string]bool)
+	for key := range db.data {
+		if strings.HasPrefix(key, prefix) {
+			found[key] = true
+		}
+	}
+	for _, op := range ops {
+		if strings.HasPrefix(op.Key, prefix) {
+			found[op.Key] = !op.Delete
+		}
+	}
+
+	keys := []string{}
+	for key, ok := range found {
+		if ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Update runs a transaction. If update returns an error, nothing's changed. Otherwise its changes are
+// written and synced to disk before Update returns.
+func (db *KVDB) Update(update func(tx *KVTx) error) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	tx := &KVTx{db: db}
+	if err := update(tx); err != nil {
+		return err
+	}
+	if len(tx.ops) == 0 {
+		return nil
+	}
+
+	frame, err := encodeKVFrame(tx.ops)
+	if err != nil {
+		return fmt.Errorf("Error encoding transaction: %s", err)
+	}
+	_, err = db.file.Write(frame)
+	if err == nil {
+		err = db.file.Sync()
+	}
+	if err != nil {
+		// don't leave part of a transaction for the next one to be appended after
+		db.file.Truncate(db.fileSize)
+		return fmt.Errorf("Error writing transaction: %s", err)
+	}
+	db.fileSize += int64(len(frame))
+	db.apply(tx.ops)
+
+	if db.opsInFile > 2*len(db.data)+kvCompactSlack {
+		if err := db.compact(); err != nil {
+			// allow this error - the log's still good, just bigger than it needs to be
+			log.WithFields(log.Fields{
+				"area": "db",
+			}).Errorf("Error compacting database: %s", err)
+		}
+	}
+	return nil
+}
+
+// Get returns the value of a key, as the transaction sees it
+func (tx *KVTx) Get(key string) ([]byte, bool) {
+	for i := len(tx.ops) - 1; i >= 0; i-- {
+		if tx.ops[i].Key == key {
+			return tx.ops[i].Value, !tx.ops[i].Delete
+		}
+	}
+	value, ok := tx.db.data[key]
+	return value, ok
+}
+
+// Keys returns every key with a prefix, sorted, as the transaction sees them
+func (tx *KVTx) Keys(prefix string) []string {
+	return tx.db.keys(prefix, tx.ops)
+}
+
+// Put sets a key
+func (tx *KVTx) Put(key string, value []byte) {
+	tx.ops = append(tx.ops, kvOp{Key: key, Value: value})
+}
+
+// PutIfChanged sets a key, unless it already has the value, to keep the log small
+func (tx *KVTx) PutIfChanged(key string, value []byte) {
+	if current, ok := tx.Get(key); !ok || !bytes.Equal(current, value) {
+		tx.Put(key, value)
+	}
+}
+
+// Delete removes a key
+func (tx *KVTx) Delete(key string) {
+	tx.ops = append(tx.ops, kvOp{Key: key, Delete: true})
+}
+
+// Compact rewrites the log with just the live keys, so old values aren't left in it
+func (db *KVDB) Compact() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return db.compact()
+}
+
+// compact rewrites the log with one transaction holding just the live keys - lock should already be held
+func (db *KVDB) compact() error {
+	ops := []kvOp{}
+	for key, value := range db.data {
+		ops = append(ops, kvOp{Key: key, Value: value})
+	}
+	frame, err := encodeKVFrame(ops)
+	if err != nil {
+		return fmt.Errorf("Error encoding database: %s", err)
+	}
+
+	// write to a temp file, then swap it in - it's opened for appending, so it can take over from db.file
+	tempPath := db.filePath + ".tmp"
+	file, err := os.OpenFile(tempPath, os.O_APPEND|os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Error creating compacted database: %s", err)
+	}
+	if _, err := file.Write(frame); err != nil {
+		file.Close()
+		return fmt.Errorf("Error writing compacted database: %s", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("Error syncing compacted database: %s", err)
+	}
+	if err := os.Rename(tempPath, db.filePath); err != nil {
+		file.Close()
+		return fmt.Errorf("Error replacing database: %s", err)
+	}
+
+	log.WithFields(log.Fields{
+		"area":   "db",
+		"before": db.opsInFile,
+		"after":  len(ops),
+	}).Infof("Compacted database")
+	db.file.Close()
+	db.file = file
+	db.opsInFile = len(ops)
+	db.fileSize = int64(len(frame))
+
+	// make sure the rename itself is on disk, or a crash could bring back the old log
+	if err := syncDir(db.filePath); err != nil {
+		return fmt.Errorf("Error syncing database directory: %s", err)
+	}
+	return nil
+}
+
+// Close closes the database
+func (db *KVDB) Close() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return db.file.Close()
+}
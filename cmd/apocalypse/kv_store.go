@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"strings"
+)
+
+// key prefixes of the server state in a KVDB
+const (
+	kvAccountPrefix  = "account/"  // account key -> Account
+	kvTweetedPrefix  = "tweeted/"  // source name -> last tweeted chance
+	kvForecastPrefix = "forecast/" // source name -> Forecast
+	kvHistoryPrefix  = "history/"  // <unix nanoseconds>/<series key> -> HistoryPoint
+	kvMigratedKey    = "meta/migrated-from"
+
+	kvHistoryMigratedKey = "meta/history-migrated-from"
+)
+
+// KVStore stores the server state in a KVDB, with a key for each account, so a save only writes
+// the accounts that changed
+type KVStore struct {
+	db *KVDB
+}
+
+// NewKVStore returns a new KVStore
+func NewKVStore(db *KVDB) *KVStore {
+	return &KVStore{
+		db: db,
+	}
+}
+
+// Load reads the server state from the database
+func (k *KVStore) Load() (*ServerState, error) {
+	serverState := &ServerState{
+		Tokens:            make(map[string]*Account),
+		LastTweetedValues: make(map[string]float32),
+		Forecasts:         make(map[string]*Forecast),
+	}
+
+	for _, key := range k.db.Keys(kvAccountPrefix) {
+		account := &Account{}
+		if err := k.unmarshal(key, account); err != nil {
+			return nil, err
+		}
+		serverState.Tokens[strings.TrimPrefix(key, kvAccountPrefix)] = account
+	}
+	for _, key := range k.db.Keys(kvTweetedPrefix) {
+		var value float32
+		if err := k.unmarshal(key, &value); err != nil {
+			return nil, err
+		}
+		serverState.LastTweetedValues[strings.TrimPrefix(key, kvTweetedPrefix)] = value
+	}
+	for _, key := range k.db.Keys(kvForecastPrefix) {
+		forecast := &Forecast{}
+		if err := k.unmarshal(key, forecast); err != nil {
+			return nil, err
+		}
+		serverState.Forecasts[strings.TrimPrefix(key, kvForecastPrefix)] = forecast
+	}
+	return serverState, nil
+}
+
+func (k *KVStore) unmarshal(key string, v interface{}) error {
+	data, _ := k.db.Get(key)
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("Error parsing %s from the database: %s", key, err)
+	}
+	return nil
+}
+
+// Save writes the server state to the database in one transaction
+func (k *KVStore) Save(serverState *ServerState) error {
+	return k.db.Update(func(tx *KVTx) error {
+		return putServerState(tx, serverState)
+	})
+}
+
+// putServerState writes the keys that changed, and deletes the ones that are gone
+func putServerState(tx *KVTx, serverState *ServerState) error {
+	values := make(map[string]interface{})
+	for key, account := range serverState.Tokens {
+		values[kvAccountPrefix+key] = account
+	}
+	for source, value := range serverState.LastTweetedValues {
+		values[kvTweetedPrefix+source] = value
+	}
+	for source, forecast := range serverState.Forecasts {
+		values[kvForecastPrefix+source] = forecast
+	}
+
+	for key, value := range values {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("Error marshalling %s: %s", key, err)
+		}
+		tx.PutIfChanged(key, data)
+	}
+	for _, prefix := range []string{kvAccountPrefix, kvTweetedPrefix, kvForecastPrefix} {
+		for _, key := range tx.Keys(prefix) {
+			if _, ok := values[key]; !ok {
+				tx.Delete(key)
+			}
+		}
+	}
+	return nil
+}
+
+// migrateFileStore copies the server state from a JSON data file into the database, the first time
+// the database is used. The data file's left alone, in case we need to go back to it.
+func migrateFileStore(db *KVDB, fileStore *FileStore) error {
+	if _, ok := db.Get(kvMigratedKey); ok || len(db.Keys(kvAccountPrefix)) > 0 {
+		return nil
+	}
+
+	serverState, err := fileStore.Load()
+	if err != nil {
+		return fmt.Errorf("Error migrating data file: %s", err)
+	}
+	migrateServerState(serverState)
+
+	err = db.Update(func(tx *KVTx) error {
+		if err := putServerState(tx, serverState); err != nil {
+			return err
+		}
+		tx.Put(kvMigratedKey, []byte(fileStore.filePath))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error migrating data file: %s", err)
+	}
+
+	log.WithFields(log.Fields{
+		"area":     "db",
+		"file":     fileStore.filePath,
+		"accounts": len(serverState.Tokens),
+	}).Infof("Migrated data file into the database")
+	return nil
+}
+
+// Compact rewrites the database with just its live keys
+func (k *KVStore) Compact() error {
+	return k.db.Compact()
+}
+
+// KVHistoryStore stores forecast history in a KVDB, with a key for each point, in time order
+type KVHistoryStore struct {
+	db *KVDB
+}
+
+// NewKVHistoryStore returns a new KVHistoryStore
+func NewKVHistoryStore(db *KVDB) *KVHistoryStore {
+	return &KVHistoryStore{
+		db: db,
+	}
+}
+
+// historyPointKey returns a point's key - its time comes first, so keys sort oldest first
+func historyPointKey(point HistoryPoint) string {
+	return fmt.Sprintf("%s%020d/%s", kvHistoryPrefix, point.Time.UnixNano(), historySeriesKey(point.Source, point.Model, point.Metric))
+}
+
+// Load reads every point from the database
+func (k *KVHistoryStore) Load() ([]HistoryPoint, error) {
+	points := []HistoryPoint{}
+	for _, key := range k.db.Keys(kvHistoryPrefix) {
+		point := HistoryPoint{}
+		data, _ := k.db.Get(key)
+		if err := json.Unmarshal(data, &point); err != nil {
+			return nil, fmt.Errorf("Error parsing %s from the database: %s", key, err)
+		}
+		points = append(points, point)
+	}
+	return points, nil
+}
+
+// Append writes points in one transaction
+func (k *KVHistoryStore) Append(points []HistoryPoint) error {
+	return k.db.Update(func(tx *KVTx) error {
+		return putHistoryPoints(tx, points)
+	})
+}
+
+// Replace writes the points that are new, and deletes the ones that are gone, in one transaction
+func (k *KVHistoryStore) Replace(points []HistoryPoint) error {
+	return k.db.Update(func(tx *KVTx) error {
+		kept := make(map[string]bool, len(points))
+		for _, point := range points {
+			kept[historyPointKey(point)] = true
+		}
+		for _, key := range tx.Keys(kvHistoryPrefix) {
+			if !kept[key] {
+				tx.Delete(key)
+			}
+		}
+		return putHistoryPoints(tx, points)
+	})
+}
+
+// Close does nothing - the database is shared with the accounts, and outlives the history
+func (k *KVHistoryStore) Close() error {
+	return nil
+}
+
+func putHistoryPoints(tx *KVTx, points []HistoryPoint) error {
+	for _, point := range points {
+		data, err := json.Marshal(point)
+		if err != nil {
+			return fmt.Errorf("Error marshalling history point: %s", err)
+		}
+		tx.PutIfChanged(historyPointKey(point), data)
+	}
+	return nil
+}
+
+// migrateHistoryFile copies forecast history from its file into the database, the first time the
+// database is used for history. The file's left alone, in case we need to go back to it.
+func migrateHistoryFile(db *KVDB, filePath string) error {
+	if _, ok := db.Get(kvHistoryMigratedKey); ok || len(db.Keys(kvHistoryPrefix)) > 0 {
+		return nil
+	}
+
+	points, err := readHistoryFile(filePath)
+	if err != nil {
+		return fmt.Errorf("Error migrating history file: %s", err)
+	}
+	err = db.Update(func(tx *KVTx) error {
+		if err := putHistoryPoints(tx, points); err != nil {
+			return err
+		}
+		tx.Put(kvHistoryMigratedKey, []byte(filePath))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error migrating history file: %s", err)
+	}
+
+	log.WithFields(log.Fields{
+		"area":   "db",
+		"file":   filePath,
+		"points": len(points),
+	}).Infof("Migrated history file into the database")
+	return nil
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestKVPath returns the path of a database in a temp directory
+func newTestKVPath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "apocalypse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	return filepath.Join(dir, "data.db")
+}
+
+// openTestKVDB opens a database, closing it when the test's done
+func openTestKVDB(t *testing.T, filePath string) *KVDB {
+	db, err := OpenKVDB(filePath)
+	if err != nil {
+		t.Fatalf("Error opening database: %s", err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+	return db
+}
+
+// putKV sets keys in one transaction
+func putKV(t *testing.T, db *KVDB, keyValues ...string) {
+	err := db.Update(func(tx *KVTx) error {
+		for i := 0; i+1 < len(keyValues); i += 2 {
+			tx.Put(keyValues[i], []byte(keyValues[i+1]))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error updating database: %s", err)
+	}
+}
+
+// assertKV fails unless the database holds exactly these keys and values
+func assertKV(t *testing.T, db *KVDB, expected map[string]string) {
+	got := make(map[string]string)
+	for _, key := range db.Keys("") {
+		value, ok := db.Get(key)
+		if !ok {
+			t.Errorf("key %s is listed, but has no value", key)
+		}
+		got[key] = string(value)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v, expected %v", got, expected)
+	}
+}
+
+// fileSize returns the size of a file
+func fileSize(t *testing.T, filePath string) int64 {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+// appendToFile appends bytes to a file, like a write that was cut short
+func appendToFile(t *testing.T, filePath string, data []byte) {
+	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKVDBReopen(t *testing.T) {
+	filePath := newTestKVPath(t)
+	db, err := OpenKVDB(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putKV(t, db, "account:T1", "one", "account:T2", "two", "history:a", "a")
+	putKV(t, db, "account:T1", "uno")
+	err = db.Update(func(tx *KVTx) error {
+		tx.Delete("account:T2")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openTestKVDB(t, filePath)
+	assertKV(t, db, map[string]string{"account:T1": "uno", "history:a": "a"})
+	if keys := db.Keys("account:"); !reflect.DeepEqual(keys, []string{"account:T1"}) {
+		t.Errorf("got keys %v", keys)
+	}
+}
+
+func TestKVDBTransactions(t *testing.T) {
+	db := openTestKVDB(t, newTestKVPath(t))
+	putKV(t, db, "a", "1", "b", "2")
+
+	// a transaction sees its own changes
+	err := db.Update(func(tx *KVTx) error {
+		tx.Put("c", []byte("3"))
+		tx.Delete("a")
+		if value, ok := tx.Get("c"); !ok || string(value) != "3" {
+			t.Errorf("transaction doesn't see its own put")
+		}
+		if _, ok := tx.Get("a"); ok {
+			t.Errorf("transaction sees a key it deleted")
+		}
+		if keys := tx.Keys(""); !reflect.DeepEqual(keys, []string{"b", "c"}) {
+			t.Errorf("transaction sees keys %v", keys)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertKV(t, db, map[string]string{"b": "2", "c": "3"})
+
+	// a failed transaction changes nothing, in memory or on disk
+	size := fileSize(t, db.filePath)
+	err = db.Update(func(tx *KVTx) error {
+		tx.Put("b", []byte("changed"))
+		return errors.New("never mind")
+	})
+	if err == nil || err.Error() != "never mind" {
+		t.Errorf("got error %v", err)
+	}
+	assertKV(t, db, map[string]string{"b": "2", "c": "3"})
+	if fileSize(t, db.filePath) != size {
+		t.Errorf("failed transaction was written")
+	}
+
+	// unchanged values aren't written again
+	err = db.Update(func(tx *KVTx) error {
+		tx.PutIfChanged("b", []byte("2"))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileSize(t, db.filePath) != size {
+		t.Errorf("unchanged value was written")
+	}
+}
+
+func TestKVDBTornTail(t *testing.T) {
+	frame, err := encodeKVFrame([]kvOp{{Key: "b", Value: []byte("torn")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string][]byte{
+		"part of the header":  frame[:3],
+		"header only":         frame[:kvFrameHeaderSize],
+		"part of the payload": frame[:len(frame)-2],
+	}
+
+	for name, torn := range tests {
+		t.Run(name, func(t *testing.T) {
+			filePath := newTestKVPath(t)
+			db, err := OpenKVDB(filePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			putKV(t, db, "a", "1")
+			db.Close()
+			committed := fileSize(t, filePath)
+			appendToFile(t, filePath, torn)
+
+			// the torn transaction never committed, so it's dropped, and the log carries on without it
+			db = openTestKVDB(t, filePath)
+			assertKV(t, db, map[string]string{"a": "1"})
+			if size := fileSize(t, filePath); size != committed {
+				t.Errorf("got %d bytes after opening, expected the torn transaction to be truncated to %d", size, committed)
+			}
+			putKV(t, db, "c", "3")
+			db.Close()
+
+			db = openTestKVDB(t, filePath)
+			assertKV(t, db, map[string]string{"a": "1", "c": "3"})
+		})
+	}
+}
+
+func TestKVDBCorruptTail(t *testing.T) {
+	filePath := newTestKVPath(t)
+	db, err := OpenKVDB(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putKV(t, db, "a", "1")
+	committed := fileSize(t, filePath)
+	putKV(t, db, "b", "2")
+	db.Close()
+
+	// flip a byte in the last transaction's payload, so its checksum fails
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-2] ^= 0xff
+	if err := ioutil.WriteFile(filePath, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openTestKVDB(t, filePath)
+	assertKV(t, db, map[string]string{"a": "1"})
+	if size := fileSize(t, filePath); size != committed {
+		t.Errorf("got %d bytes after opening, expected the corrupt transaction to be truncated to %d", size, committed)
+	}
+}
+
+func TestKVDBMidLogCorruption(t *testing.T) {
+	filePath := newTestKVPath(t)
+	db, err := OpenKVDB(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putKV(t, db, "a", "1")
+	putKV(t, db, "b", "2")
+	db.Close()
+
+	// a bad checksum with committed transactions after it isn't a torn write - refuse to open, rather
+	// than throwing the later transactions away
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[kvFrameHeaderSize+1] ^= 0xff
+	if err := ioutil.WriteFile(filePath, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err := OpenKVDB(filePath); err == nil {
+		db.Close()
+		t.Fatalf("opened a database with a corrupt transaction in the middle")
+	} else if !strings.Contains(err.Error(), "offset 0") {
+		t.Errorf("error doesn't say where the corruption is: %s", err)
+	}
+	after, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(data) {
+		t.Errorf("database was changed by a failed open")
+	}
+}
+
+func TestKVDBCompact(t *testing.T) {
+	filePath := newTestKVPath(t)
+	db, err := OpenKVDB(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putKV(t, db, "token", "oldsecret", "other", "kept")
+	putKV(t, db, "token", "newsecret")
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the old value's gone from the log, and there's no temp file left behind
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), base64.StdEncoding.EncodeToString([]byte("oldsecret"))) {
+		t.Errorf("compacted log still has the old value")
+	}
+	if _, err := os.Stat(filePath + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temp file was left behind: %v", err)
+	}
+
+	// writes after compacting go to the new log
+	putKV(t, db, "after", "compaction")
+	db.Close()
+	db = openTestKVDB(t, filePath)
+	assertKV(t, db, map[string]string{"token": "newsecret", "other": "kept", "after": "compaction"})
+}
+
+func TestKVDBCompactsAutomatically(t *testing.T) {
+	filePath := newTestKVPath(t)
+	db, err := OpenKVDB(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= kvCompactSlack+10; i++ {
+		putKV(t, db, "counter", fmt.Sprintf("%d", i), fmt.Sprintf("key%d", i%5), "x")
+	}
+	if db.opsInFile > 2*len(db.data)+kvCompactSlack {
+		t.Errorf("log wasn't compacted - %d operations for %d keys", db.opsInFile, len(db.data))
+	}
+	db.Close()
+
+	db = openTestKVDB(t, filePath)
+	expected := map[string]string{"counter": fmt.Sprintf("%d", kvCompactSlack+10)}
+	for i := 0; i < 5; i++ {
+		expected[fmt.Sprintf("key%d", i)] = "x"
+	}
+	assertKV(t, db, expected)
+}
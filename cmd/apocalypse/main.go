@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"expvar"
 	"flag"
 	"fmt"
 	"github.com/ChimeraCoder/anaconda"
@@ -8,30 +10,98 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
+	// secrets are kept out of the logs, whichever command is run
+	redactor := newRedactingFormatter(&log.TextFormatter{})
+	log.SetFormatter(redactor)
+
+	if len(os.Args) > 1 && os.Args[1] == "dead-letters" {
+		os.Exit(runDeadLettersCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		os.Exit(runRestoreCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "encryption" {
+		os.Exit(runEncryptionCommand(os.Args[2:]))
+	}
+
 	var dataFilePath string
 	var logLevel string
 	var listenOn string
 	var rootRedirectLocation string
+	var sourceNames string
+	var publicURL string
+	var slackWorkers int
+	var responseURLPrefixes string
+	var historyFilePath string
+	var historyRetention time.Duration
+	var outboxPath string
+	var deadLettersPath string
+	var shutdownTimeout time.Duration
+	var pollInterval time.Duration
+	backupPolicy := defaultBackupPolicy
+	var storeType string
+	var dbPath string
+	var encryptionKeyFilePath string
+	var eventPollInterval time.Duration
+	var redactFields string
+
+	// the poll interval can also come from the environment
+	pollIntervalDefault := defaultPollInterval
+	if env := os.Getenv("POLL_INTERVAL"); env != "" {
+		duration, err := time.ParseDuration(env)
+		if err != nil {
+			fmt.Printf("Invalid POLL_INTERVAL (%s): %s\n", env, err)
+			os.Exit(-1)
+		}
+		pollIntervalDefault = duration
+	}
 
 	flag.StringVar(&dataFilePath, "data-file-path", "", "Location of the JSON DB file")
 	flag.StringVar(&logLevel, "log-level", "info", "log level: debug, info, warning, error, fatal, panic")
+	flag.StringVar(&redactFields, "log-redact-fields", "", fmt.Sprintf("Comma-separated log fields whose values are never logged, in addition to: %s", strings.Join(defaultRedactedFields, ", ")))
 	flag.StringVar(&listenOn, "listen", "", "<host>:<port> to listen on")
 	flag.StringVar(&rootRedirectLocation, "root-redirect", "", "Where to redirect for /")
+	flag.StringVar(&storeType, "store", "json", "Where accounts and history are stored: json, the data file and history file, or db, an embedded database - switching to db copies them in")
+	flag.StringVar(&dbPath, "db-path", "", "Location of the embedded database, for -store db (default: <data-file-path>.db)")
+	flag.StringVar(&encryptionKeyFilePath, "encryption-key-file", "", "File with the keys OAuth tokens and webhook URLs are encrypted with, one per line - the first is the primary key")
+	flag.IntVar(&backupPolicy.Recent, "backup-keep-recent", defaultBackupPolicy.Recent, "How many of the newest data file backups to keep")
+	flag.DurationVar(&backupPolicy.HourlyFor, "backup-keep-hourly", defaultBackupPolicy.HourlyFor, "Keep one data file backup an hour for this long")
+	flag.DurationVar(&backupPolicy.DailyFor, "backup-keep-daily", defaultBackupPolicy.DailyFor, "Keep one data file backup a day for this long")
+	flag.StringVar(&historyFilePath, "history-file-path", "", "Location of the forecast history file, for -store json (default: <data-file-path>.history)")
+	flag.DurationVar(&historyRetention, "history-retention", 0, "How long to keep forecast history, ex: 2160h - 0 keeps everything")
+	flag.StringVar(&outboxPath, "outbox-path", "", "Directory queued notifications are stored in until they're sent (default: <data-file-path>.outbox)")
+	flag.StringVar(&deadLettersPath, "dead-letters-path", "", "Directory failed Slack messages and tweets are kept in (default: <data-file-path>.deadletters)")
+	flag.StringVar(&publicURL, "public-url", "", "URL this server can be reached at from the internet, ex: https://apocalypse.blakecaldwell.net - needed to attach charts in Slack")
+	flag.StringVar(&responseURLPrefixes, "response-url-prefixes", defaultResponseURLPrefix, "Comma-separated URL prefixes slash command response URLs must start with - only change for testing")
+	flag.DurationVar(&pollInterval, "poll-interval", pollIntervalDefault, "How often to poll forecast sources for changes - also settable with POLL_INTERVAL")
+	flag.DurationVar(&eventPollInterval, "event-poll-interval", defaultEventPollInterval, "How often to poll during scheduled events, like debates and election night")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "How long to wait for queued messages to be sent when shutting down")
+	flag.IntVar(&slackWorkers, "slack-workers", defaultSlackWorkers, "How many Slack messages to send at once")
+	flag.StringVar(&sourceNames, "sources", "538", fmt.Sprintf("Comma-separated list of forecast sources to poll: %s", strings.Join(forecastSourceNames(), ", ")))
 
 	flag.Usage = func() {
 		fmt.Println("apocalypse2016 usage:")
+		fmt.Println("  apocalypse [flags]\n  apocalypse dead-letters -h\n  apocalypse restore -h\n  apocalypse encryption -h")
 		flag.PrintDefaults()
 		fmt.Println("\nIn addition, the following environment variables are required:")
 		fmt.Println("  CLIENT_ID\n    \tSlack client ID")
 		fmt.Println("  CLIENT_SECRET\n    \tSlack client secret")
+		fmt.Println("  SIGNING_SECRET\n    \tSlack signing secret, used to verify requests from Slack")
+		fmt.Println("  VERIFICATION_TOKEN\n    \tLegacy Slack verification token - only required if SIGNING_SECRET isn't set")
 		fmt.Println("\nThe following environment variables are optional:")
 		fmt.Println("  TWITTER_CONSUMER_KEY\n    \tTwitter API consumer key")
 		fmt.Println("  TWITTER_CONSUMER_SECRET\n    \tTwitter API consumer secret")
 		fmt.Println("  TWITTER_ACCESS_TOKEN\n    \tTwitter API access token")
 		fmt.Println("  TWITTER_ACCESS_TOKEN_SECRET\n    \tTwitter API access secret")
+		fmt.Println("  ENCRYPTION_KEYS\n    \tComma-separated keys to encrypt OAuth tokens and webhook URLs with, if there's no -encryption-key-file")
+		fmt.Println("  POLL_INTERVAL\n    \tDefault for -poll-interval, ex: 2m")
+		fmt.Println("  ADMIN_TOKEN\n    \tToken for the admin API, under /admin/ - it's switched off without one")
 	}
 	flag.Parse()
 
@@ -42,25 +112,127 @@ func main() {
 		os.Exit(-1)
 	}
 	log.SetLevel(lvl)
+	redactor.AddFields(strings.Split(redactFields, ","))
 
 	clientID := os.Getenv("CLIENT_ID")
 	clientSecret := os.Getenv("CLIENT_SECRET")
+	signingSecret := os.Getenv("SIGNING_SECRET")
+	verificationToken := os.Getenv("VERIFICATION_TOKEN")
 	twitterAPIConsumerKey := os.Getenv("TWITTER_KEY")
 	twitterAPIConsumerSecret := os.Getenv("TWITTER_SECRET")
 	twitterAccessToken := os.Getenv("TWITTER_ACCESS_TOKEN")
 	twitterAccessTokenSecret := os.Getenv("TWITTER_ACCESS_TOKEN_SECRET")
+	adminToken := os.Getenv("ADMIN_TOKEN")
 
-	if clientID == "" || clientSecret == "" || dataFilePath == "" || listenOn == "" {
+	if clientID == "" || clientSecret == "" || (signingSecret == "" && verificationToken == "") || dataFilePath == "" || listenOn == "" {
+		flag.Usage()
+		os.Exit(-1)
+	}
+
+	sources, err := newForecastSources(sourceNames)
+	if err != nil {
+		fmt.Printf("Invalid forecast sources (%s): %s\n\n", sourceNames, err)
+		flag.Usage()
+		os.Exit(-1)
+	}
+
+	keyring, err := LoadKeyring(encryptionKeyFilePath, os.Getenv("ENCRYPTION_KEYS"))
+	if err != nil {
+		fmt.Printf("Invalid encryption keys: %s\n", err)
+		os.Exit(-1)
+	}
+	if keyring == nil {
+		log.Warnf("No encryption keys - OAuth tokens and webhook URLs will be stored in plaintext")
+	}
+
+	if outboxPath == "" {
+		outboxPath = dataFilePath + ".outbox"
+	}
+	outbox, err := OpenOutbox(outboxPath, keyring)
+	if err != nil {
+		fmt.Printf("Error opening outbox: %s\n", err)
+		os.Exit(-1)
+	}
+
+	if deadLettersPath == "" {
+		deadLettersPath = dataFilePath + ".deadletters"
+	}
+	deadLetters, err := OpenDeadLetters(deadLettersPath, keyring)
+	if err != nil {
+		fmt.Printf("Error opening dead letters: %s\n", err)
+		os.Exit(-1)
+	}
+
+	if historyFilePath == "" {
+		historyFilePath = dataFilePath + ".history"
+	}
+
+	var store Store
+	var historyStore HistoryStore
+	var db *KVDB // only for -store db
+	switch storeType {
+	case "json":
+		store = NewFileStore(dataFilePath, backupPolicy)
+		if historyStore, err = OpenFileHistoryStore(historyFilePath); err != nil {
+			fmt.Printf("Error opening history: %s\n", err)
+			os.Exit(-1)
+		}
+	case "db":
+		if dbPath == "" {
+			dbPath = dataFilePath + ".db"
+		}
+		if db, err = OpenKVDB(dbPath); err != nil {
+			fmt.Printf("Error opening database: %s\n", err)
+			os.Exit(-1)
+		}
+		if err := migrateFileStore(db, NewFileStore(dataFilePath, backupPolicy)); err != nil {
+			fmt.Printf("%s\n", err)
+			os.Exit(-1)
+		}
+		if err := migrateHistoryFile(db, historyFilePath); err != nil {
+			fmt.Printf("%s\n", err)
+			os.Exit(-1)
+		}
+		store = NewKVStore(db)
+		historyStore = NewKVHistoryStore(db)
+	default:
+		fmt.Printf("Invalid store: %s\n\n", storeType)
 		flag.Usage()
 		os.Exit(-1)
 	}
 
-	server, err := NewServer(clientID, clientSecret, dataFilePath)
+	history, err := OpenHistory(historyStore, historyRetention)
+	if err != nil {
+		fmt.Printf("Error opening history: %s\n", err)
+		os.Exit(-1)
+	}
+
+	server, err := NewServer(clientID, clientSecret, NewEncryptedStore(store, keyring), sources, history, outbox, deadLetters)
 	if err != nil {
 		fmt.Printf("Error instantiating Server: %s\n", err)
 		os.Exit(-1)
 	}
 
+	server.SetPublicURL(publicURL)
+	if pollInterval < 10*time.Second || eventPollInterval < 10*time.Second {
+		fmt.Printf("Poll intervals must be at least 10s\n\n")
+		flag.Usage()
+		os.Exit(-1)
+	}
+	server.SetPollIntervals(pollInterval, eventPollInterval)
+	if slackWorkers < 1 {
+		fmt.Printf("Invalid number of Slack workers: %d\n\n", slackWorkers)
+		flag.Usage()
+		os.Exit(-1)
+	}
+	server.SetSlackWorkers(slackWorkers)
+	server.SetSlackVerification(signingSecret, verificationToken)
+	server.SetAdminToken(adminToken)
+	server.SetResponseURLPrefixes(strings.Split(responseURLPrefixes, ","))
+	if signingSecret == "" {
+		log.Warnf("SIGNING_SECRET is missing - verifying Slack requests with the legacy verification token")
+	}
+
 	if twitterAPIConsumerKey != "" && twitterAPIConsumerSecret != "" && twitterAccessToken != "" && twitterAccessTokenSecret != "" {
 		anaconda.SetConsumerKey(twitterAPIConsumerKey)
 		anaconda.SetConsumerSecret(twitterAPIConsumerSecret)
@@ -69,36 +241,87 @@ func main() {
 		log.Infof("Twitter API consumer key and/or secret are missing - will not send any tweets")
 	}
 
-	// watch for ^C
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	go func() {
-		for _ = range c {
-			log.Infof("Received interrupt - waiting for all work to be done")
-			server.Stop()
-			log.Infof("Work is done - exiting")
-			os.Exit(0)
-		}
-	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.Run(ctx)
 
-	go server.Run()
-
-	// HTTP endpoints:
+	// HTTP endpoints - on our own mux, since expvar puts /debug/vars on the default one:
+	mux := http.NewServeMux()
 	if rootRedirectLocation != "" {
-		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 			http.Redirect(w, r, rootRedirectLocation, http.StatusTemporaryRedirect)
 		})
 	}
-	http.HandleFunc("/oauth", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/install", func(w http.ResponseWriter, r *http.Request) {
+		server.handleInstall(w, r)
+	})
+	mux.HandleFunc("/oauth", func(w http.ResponseWriter, r *http.Request) {
 		server.handleOAuth(w, r)
 	})
-	http.HandleFunc("/trump", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/trump", server.verifySlackRequest(func(w http.ResponseWriter, r *http.Request) {
 		server.handleTrump(w, r)
+	}))
+	mux.HandleFunc("/events", server.verifySlackRequest(func(w http.ResponseWriter, r *http.Request) {
+		server.handleEvents(w, r)
+	}))
+	mux.HandleFunc("/chart/", func(w http.ResponseWriter, r *http.Request) {
+		server.handleChart(w, r)
+	})
+	mux.HandleFunc("/api/history", func(w http.ResponseWriter, r *http.Request) {
+		server.handleHistoryAPI(w, r)
 	})
 
-	err = http.ListenAndServe(listenOn, nil)
-	if err != nil {
-		fmt.Printf("Error listening on %s: %s\n", listenOn, err)
+	mux.HandleFunc("/admin/dead-letters", server.requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		server.handleDeadLetters(w, r)
+	}))
+	mux.HandleFunc("/admin/dead-letters/", server.requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		server.handleDeadLetters(w, r)
+	}))
+
+	mux.HandleFunc("/admin/refresh", server.requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		server.handleRefresh(w, r)
+	}))
+
+	mux.HandleFunc("/admin/vars", server.requireAdmin(expvar.Handler().ServeHTTP))
+
+	httpServer := &http.Server{Addr: listenOn, Handler: mux}
+	go func() {
+		if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+			fmt.Printf("Error listening on %s: %s\n", listenOn, err)
+			os.Exit(-1)
+		}
+	}()
+
+	// wait for ^C or a kill - a second one exits right away
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	log.Infof("Received %s - waiting up to %s for all work to be done", sig, shutdownTimeout)
+	go func() {
+		sig := <-signals
+		log.Warnf("Received %s again - exiting now", sig)
+		os.Exit(-1)
+	}()
+
+	cancel()
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Errorf("Error stopping HTTP server: %s", err)
+	}
+	shutdownErr := server.Shutdown(shutdownCtx)
+	if shutdownErr != nil {
+		log.Errorf("Error shutting down: %s", shutdownErr)
+	}
+
+	// the history and data file are saved to it on shutdown, so it's closed last
+	if db != nil {
+		if err := db.Close(); err != nil {
+			log.Errorf("Error closing database: %s", err)
+			os.Exit(-1)
+		}
+	}
+	if shutdownErr != nil {
 		os.Exit(-1)
 	}
+	log.Infof("Work is done - exiting")
 }
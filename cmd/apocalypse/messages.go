@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// chanceLine formats a forecast for a message, along with the +/- change from the
+// previously-reported value, if there is one
+func chanceLine(label string, chance float32, previous float32, url string) string {
+	return fmt.Sprintf("Chance of a Trump apocalypse%s: %.1f%%%s %s", labelStr(label), chance, changeStr(chance, previous, "%"), url)
+}
+
+// stateChanceLine formats a state's forecast for a message, like chanceLine
+func stateChanceLine(state string, label string, chance float32, previous float32, url string) string {
+	return fmt.Sprintf("Chance of Trump winning %s%s: %.1f%%%s %s", _states[state], labelStr(label), chance, changeStr(chance, previous, "%"), url)
+}
+
+// changeStr builds the +/- context string, if there's a previous value to compare with
+func changeStr(now float32, previous float32, unit string) string {
+	if previous <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (%+.1f%s)", now-previous, unit)
+}
+
+// labelStr wraps a non-empty label in parentheses
+func labelStr(label string) string {
+	if label == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (%s)", label)
+}
+
+// seriesLabel returns the label to show for a series, or nothing if it's the only one being shown
+func seriesLabel(key string, seriesCount int) string {
+	if seriesCount <= 1 {
+		return ""
+	}
+	source, model := splitSeriesKey(key)
+	return fmt.Sprintf("%s %s", source, model)
+}
+
+// projectionLines formats a model's electoral and popular vote projections, along with the +/- change
+// from the previously-reported values, if there are any
+func projectionLines(key string, label string, model *ModelForecast, reported map[string]float32) []string {
+	lines := []string{}
+	if str := projectionStr(key, "ev", model.ElectoralVotes, reported, ""); str != "" {
+		lines = append(lines, fmt.Sprintf("EV%s: %s", labelStr(label), str))
+	}
+	if str := projectionStr(key, "popvote", model.PopularVote, reported, "%"); str != "" {
+		lines = append(lines, fmt.Sprintf("Popular vote%s: %s", labelStr(label), str))
+	}
+	return lines
+}
+
+// projectionStr formats one projection for every candidate, ex: "Trump 197.4 (+3.1), Clinton 339.2 (-3.1)"
+func projectionStr(key string, metric string, vals map[string]float32, reported map[string]float32, unit string) string {
+	parts := []string{}
+	for _, candidate := range _candidates {
+		val, ok := vals[candidate.party]
+		if !ok {
+			continue
+		}
+		previous := reported[projectionKey(key, metric, candidate.party)]
+		parts = append(parts, fmt.Sprintf("%s %.1f%s%s", candidate.name, val, unit, changeStr(val, previous, unit)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// projectionValues returns a model's projections, keyed for recording them as reported
+func projectionValues(key string, model *ModelForecast) map[string]float32 {
+	vals := make(map[string]float32)
+	for party, val := range model.ElectoralVotes {
+		vals[projectionKey(key, "ev", party)] = val
+	}
+	for party, val := range model.PopularVote {
+		vals[projectionKey(key, "popvote", party)] = val
+	}
+	return vals
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"expvar"
+	"time"
+)
+
+var (
+	// counters, published with the rest of expvar at /admin/vars, for admins only
+	_metrics = expvar.NewMap("apocalypse")
+)
+
+// incrementMetric adds one to a counter
+func incrementMetric(name string) {
+	_metrics.Add(name, 1)
+}
+
+// observeDuration records how long something took, as a count and a running total, so the
+// average can be worked out from two samples of /admin/vars
+func observeDuration(name string, duration time.Duration) {
+	_metrics.Add(name+"_count", 1)
+	_metrics.AddFloat(name+"_seconds_total", duration.Seconds())
+}
+
+// publishGauge publishes a value that's computed when /admin/vars is read
+func publishGauge(name string, gauge func() interface{}) {
+	_metrics.Set(name, expvar.Func(gauge))
+}
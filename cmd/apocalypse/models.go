@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"strings"
+)
+
+// defaultSeries returns the default model of every configured source
+func (s *Server) defaultSeries() []string {
+	keys := []string{}
+	for _, source := range s.sources {
+		keys = append(keys, seriesKey(source.Name(), source.Models()[0]))
+	}
+	return keys
+}
+
+// allSeries returns every model of every configured source
+func (s *Server) allSeries() []string {
+	keys := []string{}
+	for _, source := range s.sources {
+		for _, model := range source.Models() {
+			keys = append(keys, seriesKey(source.Name(), model))
+		}
+	}
+	return keys
+}
+
+// accountSeries returns the series an account wants to hear about. Selections
+// for sources that are no longer configured are ignored.
+func (s *Server) accountSeries(account *Account) []string {
+	if account == nil || len(account.Models) == 0 {
+		return s.defaultSeries()
+	}
+
+	known := make(map[string]bool)
+	for _, key := range s.allSeries() {
+		known[key] = true
+	}
+	keys := []string{}
+	for _, key := range account.Models {
+		if known[key] {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return s.defaultSeries()
+	}
+	return keys
+}
+
+// latestModel returns the most recently-fetched forecast of a series - lock should already be held
+func (s *Server) latestModel(key string) (*Forecast, *ModelForecast, bool) {
+	sourceName, model := splitSeriesKey(key)
+	forecast, ok := s.serverState.Forecasts[sourceName]
+	if !ok {
+		return nil, nil, false
+	}
+	modelForecast, ok := forecast.Models[model]
+	if !ok {
+		return nil, nil, false
+	}
+	return forecast, modelForecast, true
+}
+
+// latestChance returns the most recently-fetched chance for a series - lock should already be held
+func (s *Server) latestChance(key string) (*Forecast, float32, bool) {
+	forecast, modelForecast, ok := s.latestModel(key)
+	if !ok {
+		return nil, 0, false
+	}
+	return forecast, modelForecast.TrumpChance, true
+}
+
+// resolveModels turns model names from a user into series keys. Names can either
+// be a plain model name, like "polls-plus", or qualified with the source, like "538/polls-plus".
+func (s *Server) resolveModels(names []string) ([]string, error) {
+	all := s.allSeries()
+	keys := []string{}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		found := false
+		for _, key := range all {
+			_, model := splitSeriesKey(key)
+			if strings.EqualFold(name, key) || strings.EqualFold(name, model) {
+				found = true
+				if !seen[key] {
+					seen[key] = true
+					keys = append(keys, key)
+				}
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Unknown model: %s", name)
+		}
+	}
+	return keys, nil
+}
+
+// modelsCommand handles "/trump models [model ...]", which shows or changes the models
+// a channel is notified about. Returns the text to reply with.
+func (s *Server) modelsCommand(key string, args []string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	account, ok := s.serverState.Tokens[key]
+	if !ok {
+		return notInstalledReply
+	}
+
+	if len(args) > 0 {
+		var keys []string
+		if len(args) == 1 && strings.EqualFold(args[0], "default") {
+			keys = []string{}
+		} else {
+			var err error
+			if keys, err = s.resolveModels(args); err != nil {
+				return fmt.Sprintf("%s. Available models: %s", err, strings.Join(s.allSeries(), ", "))
+			}
+		}
+		account.Models = keys
+		if err := s.saveServerData(); err != nil {
+			log.WithFields(log.Fields{
+				"area":    "db",
+				"account": key,
+			}).Errorf("Error saving models: %s", err)
+			return "Sorry, your models couldn't be saved. Please try again later."
+		}
+	}
+
+	return fmt.Sprintf("Notifying this channel about: %s\nAvailable models: %s\nChange with `/trump models <model> [<model> ...]`, or `/trump models default`",
+		strings.Join(s.accountSeries(account), ", "), strings.Join(s.allSeries(), ", "))
+}
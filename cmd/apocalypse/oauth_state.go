@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how long someone has to finish installing the bot after starting at /install
+const oauthStateMaxAge = 10 * time.Minute
+
+// cookie tying the OAuth state to the browser that started the install
+const oauthStateCookie = "apocalypse_oauth_state"
+
+// newOAuthState generates a signed, expiring value for the OAuth 'state' parameter,
+// formatted as "<unix time>.<nonce>.<signature>"
+func newOAuthState(secret string, now time.Time) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("Error generating nonce: %s", err)
+	}
+	payload := fmt.Sprintf("%d.%s", now.Unix(), hex.EncodeToString(nonce))
+	return payload + "." + oauthStateSignature(secret, payload), nil
+}
+
+// verifyOAuthState makes sure a state value was signed by us, and hasn't expired
+func verifyOAuthState(secret string, state string, now time.Time) error {
+	parts := strings.Split(state, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("Malformed state")
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(oauthStateSignature(secret, payload))) {
+		return fmt.Errorf("State signature mismatch")
+	}
+
+	timestamp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("Malformed state timestamp")
+	}
+	age := now.Sub(time.Unix(timestamp, 0))
+	if age < 0 || age > oauthStateMaxAge {
+		return fmt.Errorf("State has expired")
+	}
+	return nil
+}
+
+// oauthStateSignature signs a state payload
+func oauthStateSignature(secret string, payload string) string {
+	mac := hmac.New(sha256.New, []byte("oauth-state:"+secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how often delivered notifications are committed to the data file
+const outboxFlushInterval = 30 * time.Second
+
+// ReportedValues are the values a notification tells a channel about. They're only recorded
+// on the account once the notification's been delivered.
+type ReportedValues struct {
+	Chances     map[string]float32 `json:"chances,omitempty"`     // series key -> chance
+	Projections map[string]float32 `json:"projections,omitempty"` // projection key -> value
+	States      map[string]float32 `json:"states,omitempty"`      // state series key -> chance
+}
+
+// OutboxEntry is a notification that's been queued, but not yet delivered
+type OutboxEntry struct {
+	ID         string         `json:"id"`
+	AccountKey string         `json:"account_key"`
+	URL        string         `json:"url"`
+	Message    string         `json:"message"`
+	Quip       string         `json:"quip"`
+	ImageURL   string         `json:"image_url,omitempty"`
+	QueuedAt   time.Time      `json:"queued_at"`
+	Reported   ReportedValues `json:"reported"`
+
+	batch     string // ID of the file it's stored in
+	delivered bool   // sent, but not yet committed to the data file
+}
+
+// Outbox stores queued notifications on disk so they're not lost if we crash or restart before
+// they're sent. Each poll's notifications are written together, as one JSON file, so there's one
+// sync per poll rather than one per channel.
+type Outbox struct {
+	dirPath string
+	keyring *Keyring // webhook URLs are encrypted with it, if it's set
+	mutex   sync.Mutex
+	entries map[string]*OutboxEntry            // by ID
+	batches map[string]map[string]*OutboxEntry // file ID -> the entries still in it, by ID
+	pending map[string]map[string]*OutboxEntry // account key -> its undelivered entries, by ID
+	lastID  int64                              // IDs are queue times, in nanoseconds, bumped to be unique
+}
+
+// OpenOutbox loads the notifications left in the outbox directory, creating it if needed. Files with
+// webhook URLs in plaintext, or encrypted with an old key, are rewritten.
+func OpenOutbox(dirPath string, keyring *Keyring) (*Outbox, error) {
+	if err := os.MkdirAll(dirPath, 0755); err != nil {
+		return nil, fmt.Errorf("Error creating outbox directory: %s", err)
+	}
+	files, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading outbox directory: %s", err)
+	}
+
+	o := &Outbox{
+		dirPath: dirPath,
+		keyring: keyring,
+		entries: make(map[string]*OutboxEntry),
+		batches: make(map[string]map[string]*OutboxEntry),
+		pending: make(map[string]map[string]*OutboxEntry),
+	}
+	for _, file := range files {
+		filePath := filepath.Join(dirPath, file.Name())
+		if !strings.HasSuffix(file.Name(), ".json") {
+			// left behind by a crash mid-write - the messages were never queued
+			os.Remove(filePath)
+			continue
+		}
+		data, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading outbox file %s: %s", file.Name(), err)
+		}
+		entries, err := parseOutboxFile(data)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"area": "outbox",
+				"file": file.Name(),
+			}).Errorf("Skipping unreadable outbox file: %s", err)
+			continue
+		}
+		batch := strings.TrimSuffix(file.Name(), ".json")
+		stale := false
+		for _, entry := range entries {
+			url, staleURL, err := decryptSecret(keyring, entry.URL)
+			if err != nil {
+				return nil, fmt.Errorf("Error decrypting outbox file %s: %s", file.Name(), err)
+			}
+			entry.URL = url
+			stale = stale || staleURL
+			entry.batch = batch
+			o.index(entry)
+			if id, err := strconv.ParseInt(entry.ID, 10, 64); err == nil && id > o.lastID {
+				o.lastID = id
+			}
+		}
+		if stale {
+			if err := o.writeBatch(batch, entries); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return o, nil
+}
+
+// parseOutboxFile reads the entries in an outbox file. Older versions wrote one entry per file.
+func parseOutboxFile(data []byte) ([]*OutboxEntry, error) {
+	entries := []*OutboxEntry{}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		entry := &OutboxEntry{}
+		if err := json.Unmarshal(data, entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	} else if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.ID == "" {
+			return nil, fmt.Errorf("outbox entry has no ID")
+		}
+	}
+	return entries, nil
+}
+
+// Add stores notifications, giving them IDs. They're written and synced as one file.
+func (o *Outbox) Add(entries []*OutboxEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	// IDs sort in the order notifications were queued
+	id := time.Now().UnixNano()
+	if id <= o.lastID {
+		id = o.lastID + 1
+	}
+	batch := fmt.Sprintf("%020d", id)
+	for i, entry := range entries {
+		entry.ID = fmt.Sprintf("%020d", id+int64(i))
+		entry.batch = batch
+	}
+
+	if err := o.writeBatch(batch, entries); err != nil {
+		for _, entry := range entries {
+			entry.ID = ""
+			entry.batch = ""
+		}
+		return err
+	}
+	for _, entry := range entries {
+		o.index(entry)
+	}
+	o.lastID = id + int64(len(entries)) - 1
+	return nil
+}
+
+// Pending returns the notifications that haven't been delivered, oldest first
+func (o *Outbox) Pending() []*OutboxEntry {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	pending := []*OutboxEntry{}
+	for _, entries := range o.pending {
+		for _, entry := range entries {
+			pending = append(pending, entry)
+		}
+	}
+	sortOutboxEntries(pending)
+	return pending
+}
+
+// PendingReported returns an account with the values of its undelivered notifications applied,
+// so the same change isn't queued again while they're waiting to be sent
+func (o *Outbox) PendingReported(key string, account *Account) *Account {
+	reported := *account
+	reported.ReportedChances = copyValues(account.ReportedChances)
+	reported.ReportedProjections = copyValues(account.ReportedProjections)
+	reported.ReportedStates = copyValues(account.ReportedStates)
+
+	o.mutex.Lock()
+	pending := []*OutboxEntry{}
+	for _, entry := range o.pending[key] {
+		pending = append(pending, entry)
+	}
+	o.mutex.Unlock()
+
+	// newer notifications' values win
+	sortOutboxEntries(pending)
+	for _, entry := range pending {
+		entry.Reported.applyTo(&reported)
+	}
+	return &reported
+}
+
+// Delivered marks a notification as sent, returning it. It stays on disk until RemoveDelivered is
+// called, after the account's been saved.
+func (o *Outbox) Delivered(id string) (*OutboxEntry, bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	entry, ok := o.entries[id]
+	if ok {
+		entry.delivered = true
+		o.unindexPending(entry)
+	}
+	return entry, ok
+}
+
+// DeliveredCount returns how many delivered notifications are waiting for RemoveDelivered
+func (o *Outbox) DeliveredCount() int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	count := 0
+	for _, entry := range o.entries {
+		if entry.delivered {
+			count++
+		}
+	}
+	return count
+}
+
+// RemoveDelivered removes every delivered notification, rewriting each file they were in once
+func (o *Outbox) RemoveDelivered() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	changed := make(map[string]bool)
+	for _, entry := range o.entries {
+		if entry.delivered {
+			changed[entry.batch] = true
+		}
+	}
+	for batch := range changed {
+		remaining := []*OutboxEntry{}
+		for _, entry := range o.batches[batch] {
+			if !entry.delivered {
+				remaining = append(remaining, entry)
+			}
+		}
+		if err := o.rewriteBatch(batch, remaining); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove drops a notification, whether or not it was delivered
+func (o *Outbox) Remove(id string) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	entry, ok := o.entries[id]
+	if !ok {
+		return nil
+	}
+	remaining := []*OutboxEntry{}
+	for _, other := range o.batches[entry.batch] {
+		if other != entry {
+			remaining = append(remaining, other)
+		}
+	}
+	return o.rewriteBatch(entry.batch, remaining)
+}
+
+// Len returns how many notifications are in the outbox
+func (o *Outbox) Len() int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return len(o.entries)
+}
+
+// rewriteBatch rewrites a file with just the entries that are left in it, dropping the rest from
+// the outbox, or removes it if there are none left - lock should already be held
+func (o *Outbox) rewriteBatch(batch string, remaining []*OutboxEntry) error {
+	if len(remaining) == 0 {
+		if err := os.Remove(o.batchPath(batch)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Error removing outbox file: %s", err)
+		}
+	} else {
+		sortOutboxEntries(remaining)
+		if err := o.writeBatch(batch, remaining); err != nil {
+			return err
+		}
+	}
+
+	kept := make(map[string]bool, len(remaining))
+	for _, entry := range remaining {
+		kept[entry.ID] = true
+	}
+	for id, entry := range o.batches[batch] {
+		if !kept[id] {
+			o.unindex(entry)
+		}
+	}
+	return nil
+}
+
+// writeBatch writes and syncs a file of entries, with their webhook URLs encrypted - lock should already be held
+func (o *Outbox) writeBatch(batch string, entries []*OutboxEntry) error {
+	stored := make([]OutboxEntry, len(entries))
+	for i, entry := range entries {
+		stored[i] = *entry
+		url, err := encryptSecret(o.keyring, entry.URL)
+		if err != nil {
+			return fmt.Errorf("Error encrypting outbox entry: %s", err)
+		}
+		stored[i].URL = url
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return fmt.Errorf("Error marshalling outbox entries: %s", err)
+	}
+	if err := writeFileSynced(o.batchPath(batch), data, 0600); err != nil {
+		return fmt.Errorf("Error writing outbox entries: %s", err)
+	}
+	return nil
+}
+
+// index adds an entry to the lookups - lock should already be held
+func (o *Outbox) index(entry *OutboxEntry) {
+	o.entries[entry.ID] = entry
+	if o.batches[entry.batch] == nil {
+		o.batches[entry.batch] = make(map[string]*OutboxEntry)
+	}
+	o.batches[entry.batch][entry.ID] = entry
+	if !entry.delivered {
+		if o.pending[entry.AccountKey] == nil {
+			o.pending[entry.AccountKey] = make(map[string]*OutboxEntry)
+		}
+		o.pending[entry.AccountKey][entry.ID] = entry
+	}
+}
+
+// unindex removes an entry from the lookups - lock should already be held
+func (o *Outbox) unindex(entry *OutboxEntry) {
+	delete(o.entries, entry.ID)
+	delete(o.batches[entry.batch], entry.ID)
+	if len(o.batches[entry.batch]) == 0 {
+		delete(o.batches, entry.batch)
+	}
+	o.unindexPending(entry)
+}
+
+// unindexPending removes an entry from its account's undelivered entries - lock should already be held
+func (o *Outbox) unindexPending(entry *OutboxEntry) {
+	delete(o.pending[entry.AccountKey], entry.ID)
+	if len(o.pending[entry.AccountKey]) == 0 {
+		delete(o.pending, entry.AccountKey)
+	}
+}
+
+func (o *Outbox) batchPath(batch string) string {
+	return filepath.Join(o.dirPath, batch+".json")
+}
+
+// sortOutboxEntries sorts entries oldest first
+func sortOutboxEntries(entries []*OutboxEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID < entries[j].ID
+	})
+}
+
+// applyTo records the values on an account
+func (r ReportedValues) applyTo(account *Account) {
+	for key, value := range r.Chances {
+		account.ReportedChances[key] = value
+	}
+	for key, value := range r.Projections {
+		account.ReportedProjections[key] = value
+	}
+	for key, value := range r.States {
+		account.ReportedStates[key] = value
+	}
+}
+
+// recordedOn returns whether the account already has all of the values
+func (r ReportedValues) recordedOn(account *Account) bool {
+	for _, values := range []struct{ reported, recorded map[string]float32 }{
+		{r.Chances, account.ReportedChances},
+		{r.Projections, account.ReportedProjections},
+		{r.States, account.ReportedStates},
+	} {
+		for key, value := range values.reported {
+			if recorded, ok := values.recorded[key]; !ok || recorded != value {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func copyValues(values map[string]float32) map[string]float32 {
+	copied := make(map[string]float32, len(values))
+	for key, value := range values {
+		copied[key] = value
+	}
+	return copied
+}
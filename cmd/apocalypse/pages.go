@@ -0,0 +1,57 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"html/template"
+	"net/http"
+)
+
+var (
+	// simple page for telling people how their install went
+	_pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Apocalypse Trump - {{.Title}}</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 4em auto; padding: 0 1em; color: #333; }
+h1 { font-size: 1.5em; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+{{if .LinkURL}}<p><a href="{{.LinkURL}}">{{.LinkText}}</a></p>{{end}}
+</body>
+</html>
+`))
+)
+
+// page is the content of an HTML page
+type page struct {
+	Title    string
+	Message  string
+	LinkURL  string // optional link, ex: to try installing again
+	LinkText string
+}
+
+// renderPage writes an HTML page with the given status
+func renderPage(w http.ResponseWriter, status int, p page) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := _pageTemplate.Execute(w, p); err != nil {
+		log.WithFields(log.Fields{
+			"area": "http",
+		}).Errorf("Error rendering page: %s", err)
+	}
+}
+
+// renderInstallError writes an HTML error page for a failed install, with a link to try again
+func renderInstallError(w http.ResponseWriter, status int, message string) {
+	renderPage(w, status, page{
+		Title:    "Something went wrong",
+		Message:  message,
+		LinkURL:  "/install",
+		LinkText: "Try adding the bot again",
+	})
+}
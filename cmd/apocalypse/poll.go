@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	log "github.com/Sirupsen/logrus"
+	"github.com/azr/backoff"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// how often we poll for changes, unless configured otherwise
+const defaultPollInterval = 5 * time.Minute
+
+// how often we poll during scheduled events, unless configured otherwise
+const defaultEventPollInterval = time.Minute
+
+// poll intervals are stretched or shrunk by up to this fraction, so we don't hit sources like clockwork
+const pollJitter = 0.1
+
+// longest we'll wait between fetches from a failing source
+const maxFetchBackOff = time.Hour
+
+// PollEvent is a stretch of time when forecasts move fast, so we poll more often
+type PollEvent struct {
+	Name  string
+	Start time.Time
+	End   time.Time
+}
+
+var (
+	// US Eastern, for the event schedule - daylight saving time ended on November 6th, 2016
+	_edt = time.FixedZone("EDT", -4*60*60)
+	_est = time.FixedZone("EST", -5*60*60)
+
+	// scheduled events - from a few hours before each debate to the morning after, and all of election day and night
+	_pollEvents = []PollEvent{
+		{"First presidential debate", time.Date(2016, 9, 26, 18, 0, 0, 0, _edt), time.Date(2016, 9, 27, 6, 0, 0, 0, _edt)},
+		{"Vice presidential debate", time.Date(2016, 10, 4, 18, 0, 0, 0, _edt), time.Date(2016, 10, 5, 6, 0, 0, 0, _edt)},
+		{"Second presidential debate", time.Date(2016, 10, 9, 18, 0, 0, 0, _edt), time.Date(2016, 10, 10, 6, 0, 0, 0, _edt)},
+		{"Third presidential debate", time.Date(2016, 10, 19, 18, 0, 0, 0, _edt), time.Date(2016, 10, 20, 6, 0, 0, 0, _edt)},
+		{"Election day", time.Date(2016, 11, 8, 5, 0, 0, 0, _est), time.Date(2016, 11, 9, 12, 0, 0, 0, _est)},
+	}
+)
+
+// currentPollEvent returns the scheduled event happening at a time, if there is one
+func currentPollEvent(now time.Time) (PollEvent, bool) {
+	for _, event := range _pollEvents {
+		if !now.Before(event.Start) && now.Before(event.End) {
+			return event, true
+		}
+	}
+	return PollEvent{}, false
+}
+
+// nextPollEventStart returns when the next scheduled event starts, or the zero time if there isn't one
+func nextPollEventStart(now time.Time) time.Time {
+	next := time.Time{}
+	for _, event := range _pollEvents {
+		if event.Start.After(now) && (next.IsZero() || event.Start.Before(next)) {
+			next = event.Start
+		}
+	}
+	return next
+}
+
+// jitter stretches or shrinks a duration by up to pollJitter
+func jitter(duration time.Duration) time.Duration {
+	return time.Duration(float64(duration) * (1 + pollJitter*(2*rand.Float64()-1)))
+}
+
+// pollDelay returns how long to wait before polling again
+func (s *Server) pollDelay(now time.Time) time.Duration {
+	if event, ok := currentPollEvent(now); ok {
+		log.WithFields(log.Fields{
+			"area":  "fetch",
+			"event": event.Name,
+		}).Debugf("Polling faster during scheduled event")
+		return jitter(s.eventPollInterval)
+	}
+
+	delay := jitter(s.pollInterval)
+	if next := nextPollEventStart(now); !next.IsZero() && next.Sub(now) < delay {
+		// don't sleep through the start of an event
+		delay = next.Sub(now)
+	}
+	return delay
+}
+
+// waitToPoll sleeps until it's time to poll again, or a refresh is asked for. Returns false if ctx was
+// cancelled first.
+func (s *Server) waitToPoll(ctx context.Context) bool {
+	timer := time.NewTimer(s.pollDelay(time.Now()))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+	case <-s.refreshChan:
+		log.WithFields(log.Fields{
+			"area": "fetch",
+		}).Infof("Refreshing forecasts on request")
+
+		// the admin wants fresh data, even from sources we're backing off from
+		s.fetchBackOffs = make(map[string]*fetchBackOff)
+	}
+	return true
+}
+
+// refresh asks the polling loop to poll right away. Returns false if a refresh was already waiting.
+func (s *Server) refresh() bool {
+	select {
+	case s.refreshChan <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// handleRefresh is the admin API for polling right away: POST /admin/refresh
+func (s *Server) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.refresh() {
+		log.WithFields(log.Fields{
+			"request": r.URL.Path,
+		}).Debugf("Refresh already requested")
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// fetchBackOff tracks a failing source, which is fetched less and less often until it works again
+type fetchBackOff struct {
+	backOff *backoff.ExponentialBackOff
+	retryAt time.Time
+}
+
+// readyToFetch returns whether a source isn't being backed off from - only called from the polling loop
+func (s *Server) readyToFetch(source string, now time.Time) bool {
+	b, ok := s.fetchBackOffs[source]
+	if !ok {
+		return true
+	}
+	// polls are jittered, so one that's a little early still counts
+	early := time.Duration(2 * pollJitter * float64(s.pollInterval))
+	return !now.Add(early).Before(b.retryAt)
+}
+
+// fetchFailed backs off from a source after a failed fetch, returning how long until it's tried again -
+// only called from the polling loop
+func (s *Server) fetchFailed(source string, now time.Time) time.Duration {
+	b, ok := s.fetchBackOffs[source]
+	if !ok {
+		b = &fetchBackOff{backOff: backoff.NewExponential()}
+		b.backOff.InitialInterval = s.pollInterval
+		b.backOff.MaxInterval = maxFetchBackOff
+		b.backOff.Multiplier = 2
+		b.backOff.RandomizationFactor = pollJitter
+		b.backOff.Reset()
+		s.fetchBackOffs[source] = b
+	}
+	delay := b.backOff.GetSleepTime()
+	b.backOff.IncrementCurrentInterval()
+	b.retryAt = now.Add(delay)
+	return delay
+}
+
+// fetchSucceeded stops backing off from a source - only called from the polling loop
+func (s *Server) fetchSucceeded(source string) {
+	delete(s.fetchBackOffs, source)
+}
@@ -6,32 +6,37 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// HTTPError is returned when a request gets a non-2xx response
+type HTTPError struct {
+	URL        string
+	StatusCode int
+	Body       string        // trimmed response body - Slack puts its error code here, ex: "channel_is_archived"
+	RetryAfter time.Duration // how long the server asked us to wait before trying again, if it did
+}
+
+// Error formats the error
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("Error posting to %s: HTTP %d: %s", e.URL, e.StatusCode, e.Body)
+}
+
 // post the request to the target url
-// TODO: check/handle HTTP response code
 func postRequest(url string, postBody string) ([]byte, error) {
 	var reqBytes = []byte(postBody)
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(reqBytes))
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("Error posting to %s: %s", url, err)
-	}
-	defer resp.Body.Close()
-
-	respBytes, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("Error reading response body to %s: %s", postBody, err)
+		return nil, fmt.Errorf("Error creating request to %s: %s", url, err)
 	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
 
-	return respBytes, nil
+	return doRequest(req)
 }
 
 // post JSON to a url
-// TODO: check/handle HTTP response code
 func postJSON(url string, request interface{}) ([]byte, error) {
 	jsonBytes, err := json.Marshal(request)
 	if err != nil {
@@ -39,8 +44,18 @@ func postJSON(url string, request interface{}) ([]byte, error) {
 	}
 
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonBytes))
+	if err != nil {
+		return nil, fmt.Errorf("Error creating request to %s: %s", url, err)
+	}
 	req.Header.Set("Content-Type", "application/json; charset=utf-8")
 
+	return doRequest(req)
+}
+
+// send the request, returning the response body, or an *HTTPError if the response isn't a 2xx
+func doRequest(req *http.Request) ([]byte, error) {
+	url := req.URL.String()
+
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
@@ -53,5 +68,33 @@ func postJSON(url string, request interface{}) ([]byte, error) {
 		return nil, fmt.Errorf("Error reading response body to %s: %s", url, err)
 	}
 
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return respBytes, &HTTPError{
+			URL:        url,
+			StatusCode: resp.StatusCode,
+			Body:       strings.TrimSpace(string(respBytes)),
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+
 	return respBytes, nil
 }
+
+// parseRetryAfter parses a Retry-After header, which is either a number of seconds or an HTTP date.
+// Returns 0 if there isn't one.
+func parseRetryAfter(retryAfter string, now time.Time) time.Duration {
+	retryAfter = strings.TrimSpace(retryAfter)
+	if retryAfter == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(retryAfter); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(retryAfter); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
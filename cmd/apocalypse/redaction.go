@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"regexp"
+	"strings"
+)
+
+// redactedValue replaces secrets in log output
+const redactedValue = "[REDACTED]"
+
+// defaultRedactedFields are log fields whose values are never written, whatever they look like
+var defaultRedactedFields = []string{
+	"token",
+	"access_token",
+	"bot_access_token",
+	"client_secret",
+	"signing_secret",
+	"verification_token",
+	"code",
+	"authorization",
+	"password",
+}
+
+// token-shaped values: Slack OAuth tokens, and the incoming webhook and slash command response URLs
+// that can be posted to without any other credentials. The prefix is kept, so you can still tell what it was.
+// URLs are matched however they're written - in any case, or with a port or user info - since a
+// mangled URL is logged when it's rejected.
+var _redactedPatterns = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(`\b(xox[abposr])-[A-Za-z0-9-]+`), "$1-" + redactedValue},
+	{regexp.MustCompile(`(?i)(https?://)(?:[^/@\s"]*@)?(hooks\.slack\.com)(?::[0-9]*)?/[A-Za-z0-9/_.-]*`), "$1$2/" + redactedValue},
+}
+
+// redactingFormatter is a logrus formatter that removes secrets from log entries before another
+// formatter writes them: the values of configured field names, and anything token-shaped in the
+// message or in any field.
+type redactingFormatter struct {
+	formatter log.Formatter
+	fields    map[string]bool // lower-cased field names
+}
+
+// newRedactingFormatter returns a redactingFormatter for the default fields
+func newRedactingFormatter(formatter log.Formatter) *redactingFormatter {
+	r := &redactingFormatter{
+		formatter: formatter,
+		fields:    make(map[string]bool),
+	}
+	r.AddFields(defaultRedactedFields)
+	return r
+}
+
+// AddFields adds field names to redact - only call this before logging starts
+func (r *redactingFormatter) AddFields(fieldNames []string) {
+	for _, fieldName := range fieldNames {
+		fieldName = strings.ToLower(strings.TrimSpace(fieldName))
+		if fieldName != "" {
+			r.fields[fieldName] = true
+		}
+	}
+}
+
+// Format redacts a copy of the entry, so the caller's fields aren't changed, then formats it
+func (r *redactingFormatter) Format(entry *log.Entry) ([]byte, error) {
+	redacted := *entry
+	redacted.Message = redactString(entry.Message)
+	redacted.Data = make(log.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		redacted.Data[key] = r.redactField(key, value)
+	}
+	return r.formatter.Format(&redacted)
+}
+
+// redactField returns a field's value with its secrets removed
+func (r *redactingFormatter) redactField(key string, value interface{}) interface{} {
+	if r.fields[strings.ToLower(key)] {
+		if value == nil || value == "" {
+			// it's useful to know a secret was missing
+			return value
+		}
+		return redactedValue
+	}
+	switch v := value.(type) {
+	case string:
+		return redactString(v)
+	case error:
+		return redactString(v.Error())
+	case fmt.Stringer:
+		return redactString(v.String())
+	}
+	return value
+}
+
+// redactString replaces token-shaped values in a string
+func redactString(s string) string {
+	for _, redacted := range _redactedPatterns {
+		s = redacted.pattern.ReplaceAllString(s, redacted.replacement)
+	}
+	return s
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Slack sends slash command response URLs on this domain
+const defaultResponseURLPrefix = "https://hooks.slack.com/"
+
+// validateResponseURL makes sure a response URL is one Slack would have sent us, so we can't be
+// used to POST to arbitrary URLs. The URL must match the scheme and host of one of the allowed
+// prefixes, and start with its path.
+func validateResponseURL(responseURL string, allowedPrefixes []string) error {
+	parsed, err := url.Parse(responseURL)
+	if err != nil {
+		return fmt.Errorf("Invalid response URL: %s", err)
+	}
+	if parsed.User != nil {
+		return fmt.Errorf("Response URL can't contain credentials")
+	}
+
+	for _, prefix := range allowedPrefixes {
+		allowed, err := url.Parse(strings.TrimSpace(prefix))
+		if err != nil {
+			continue
+		}
+		if parsed.Scheme == allowed.Scheme && strings.EqualFold(parsed.Host, allowed.Host) && strings.HasPrefix(parsed.Path, allowed.Path) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Response URL isn't allowed: %s://%s", parsed.Scheme, parsed.Host)
+}
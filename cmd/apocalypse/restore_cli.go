@@ -0,0 +1,132 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// runRestoreCommand handles "apocalypse restore ...", which lists the backups of a data file, compares
+// their accounts with the data file's, and puts one back. Returns the exit code.
+func runRestoreCommand(args []string) int {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	dataFilePath := flags.String("data-file-path", "", "Location of the JSON DB file")
+	flags.Usage = func() {
+		fmt.Println("apocalypse2016 restore usage:")
+		fmt.Println("  apocalypse restore -data-file-path <path> list")
+		fmt.Println("  apocalypse restore -data-file-path <path> diff <backup>")
+		fmt.Println("  apocalypse restore -data-file-path <path> restore <backup>")
+		flags.PrintDefaults()
+		fmt.Println("\nStop the bot before restoring - it would overwrite the restored file on its next save.")
+	}
+	flags.Parse(args)
+
+	if *dataFilePath == "" || flags.NArg() == 0 || (flags.Arg(0) != "list" && flags.NArg() != 2) {
+		flags.Usage()
+		return -1
+	}
+
+	backups, err := listBackups(*dataFilePath)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		return -1
+	}
+	current, err := NewFileStore(*dataFilePath, defaultBackupPolicy).Load()
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		fmt.Println("Comparing against an empty data file")
+		current = &ServerState{}
+	}
+	migrateServerState(current)
+
+	switch flags.Arg(0) {
+	case "list":
+		if len(backups) == 0 {
+			fmt.Println("No backups")
+		}
+		for _, backup := range backups {
+			serverState, err := backup.load()
+			if err != nil {
+				fmt.Printf("%s  %s  unreadable: %s\n", backup.ID(), backup.Time.Format(time.RFC3339), err)
+				continue
+			}
+			added, removed := diffAccounts(current, serverState)
+			fmt.Printf("%s  %s  %4d accounts  %+d/-%d vs current\n",
+				backup.ID(), backup.Time.Format(time.RFC3339), len(serverState.Tokens), len(added), len(removed))
+		}
+		return 0
+	case "diff", "restore":
+	default:
+		flags.Usage()
+		return -1
+	}
+
+	var backup *Backup
+	for i := range backups {
+		if backups[i].ID() == flags.Arg(1) {
+			backup = &backups[i]
+		}
+	}
+	if backup == nil {
+		fmt.Printf("No backup %s - see `apocalypse restore -data-file-path %s list`\n", flags.Arg(1), *dataFilePath)
+		return -1
+	}
+	serverState, err := backup.load()
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		return -1
+	}
+
+	added, removed := diffAccounts(current, serverState)
+	fmt.Printf("Backup %s from %s has %d accounts, the data file has %d\n",
+		backup.ID(), backup.Time.Format(time.RFC3339), len(serverState.Tokens), len(current.Tokens))
+	for _, key := range added {
+		fmt.Printf("  + %s\n", accountDescription(key, serverState.Tokens[key]))
+	}
+	for _, key := range removed {
+		fmt.Printf("  - %s\n", accountDescription(key, current.Tokens[key]))
+	}
+	if flags.Arg(0) == "diff" {
+		return 0
+	}
+
+	// back up the data file first, so the restore can be undone
+	data, err := backup.read()
+	if err == nil {
+		err = writeBackup(*dataFilePath, time.Now())
+	}
+	if err == nil {
+		err = writeFileSynced(*dataFilePath, data, 0644)
+	}
+	if err != nil {
+		fmt.Printf("Error restoring backup: %s\n", err)
+		return -1
+	}
+	fmt.Printf("Restored backup %s\n", backup.ID())
+	return 0
+}
+
+// diffAccounts returns the keys of the accounts only in the backup, and only in the current state
+func diffAccounts(current *ServerState, backup *ServerState) ([]string, []string) {
+	added := []string{}
+	for key := range backup.Tokens {
+		if _, ok := current.Tokens[key]; !ok {
+			added = append(added, key)
+		}
+	}
+	removed := []string{}
+	for key := range current.Tokens {
+		if _, ok := backup.Tokens[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+// accountDescription describes an account on one line
+func accountDescription(key string, account *Account) string {
+	return fmt.Sprintf("%s (%s #%s)", key, account.TeamName, account.IncomingWebhook.ChannelName)
+}
@@ -1,90 +1,132 @@
 package main
 
 import (
+	"context"
+	"crypto/hmac"
 	"encoding/json"
 	"fmt"
 	"github.com/ChimeraCoder/anaconda"
 	log "github.com/Sirupsen/logrus"
-	"io/ioutil"
+	"github.com/azr/backoff"
 	"math/rand"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 )
 
 // SlackMessage is a text message to send to a Slack channel
 type SlackMessage struct {
-	url       string
-	message   string
-	quip      string
-	logFields log.Fields
+	accountKey string // account the message is for, if it's going to an installed webhook
+	url        string
+	message    string
+	quip       string
+	imageURL   string    // optional chart to attach
+	outboxID   string    // set if the message is stored in the outbox
+	queuedAt   time.Time // when the message was queued, for measuring latency
+	logFields  log.Fields
+
+	attempts     int                         // how many times we've tried to send it
+	retryBackOff *backoff.ExponentialBackOff // set once an attempt's failed
 }
 
 // Tweet contains the info to tweet a change.
 type Tweet struct {
+	source        string
+	url           string
+	chartKey      string // series to attach a chart of
 	percentNow    float32
 	percentChange float32
+	retried       bool // resent from the dead letters, so it doesn't change what was last tweeted
 	logFields     log.Fields
 }
 
 // ServerState holds the state between runs
 type ServerState struct {
-	Tokens           map[string]*Account `json:"tokens"` // a map of tokens -> all info we have about an integration. Stored as JSON for our DB
-	LastTweetedValue float32             `json:"last_tweeted_value"`
+	Tokens            map[string]*Account  `json:"tokens"`                       // account key (team + channel) -> all info we have about an integration. Stored as JSON for our DB
+	LastTweetedValue  float32              `json:"last_tweeted_value,omitempty"` // deprecated - only read to migrate old data files
+	LastTweetedValues map[string]float32   `json:"last_tweeted_values"`          // forecast source name -> last tweeted chance of its default model
+	Forecasts         map[string]*Forecast `json:"forecasts"`                    // most recent forecast from each source, by source name
 }
 
 // Server handles polling for changes and reporting to the Slack channels on change.
 type Server struct {
-	clientID     string // publicly-available Slack ID of this client
-	clientSecret string // top-secret password with Slack for our clientID
-	currentValue float32
-	mutex        sync.Mutex
-	dataFilePath string               // for now, the database is just a JSON dump of our 'tokens' map
-	outChan      chan SlackMessage    // queue of messages to be delivered to Slack channels
-	quitChan     chan interface{}     // quit channel - closed when we need to wrap up and exit
-	waitGroup    sync.WaitGroup       // used along with quitChan to keep track of pending work
-	twitterAPI   *anaconda.TwitterApi // Twitter API
-	tweetChan    chan Tweet           // queue of messages to be delivered as Tweets
+	clientID            string                   // publicly-available Slack ID of this client
+	clientSecret        string                   // top-secret password with Slack for our clientID
+	signingSecret       string                   // secret Slack signs its requests to us with
+	verificationToken   string                   // legacy token Slack sends with its requests, used if there's no signing secret
+	responseURLPrefixes []string                 // slash command response URLs must start with one of these
+	sources             []ForecastSource         // where we get our forecasts from
+	history             *History                 // every forecast value we've fetched
+	outbox              *Outbox                  // notifications waiting to be sent
+	deadLetters         *DeadLetters             // messages and tweets we gave up on
+	adminToken          string                   // token for the admin API - it's switched off without one
+	pollInterval        time.Duration            // how often we poll for changes
+	eventPollInterval   time.Duration            // how often we poll during scheduled events
+	refreshChan         chan struct{}            // asks the polling loop to poll right away
+	fetchBackOffs       map[string]*fetchBackOff // sources we're backing off from, by name - only used by the polling loop
+	publicURL           string                   // where this server can be reached from the internet, for linking to charts
+	mutex               sync.Mutex
+	store               Store                // where serverState is kept between runs
+	outChan             chan SlackMessage    // queue of messages to be delivered to Slack channels
+	quitChan            chan interface{}     // quit channel - closed when we need to wrap up and exit
+	runDone             chan interface{}     // closed when Run returns
+	waitGroup           sync.WaitGroup       // used along with quitChan to keep track of pending work
+	stopMutex           sync.Mutex           // guards stopped, so work can't be added once Shutdown's waiting
+	stopped             bool                 // set when Shutdown starts waiting for pending work
+	twitterAPI          *anaconda.TwitterApi // Twitter API
+	tweetChan           chan Tweet           // queue of messages to be delivered as Tweets
+	slackRateLimiter    *slackRateLimiter    // limits how fast we send to each webhook
+	slackWorkers        int                  // how many Slack messages can be sent at once
 
 	serverState *ServerState
 }
 
 // NewServer returns a new Server
-func NewServer(clientID string, clientSecret string, dataFilePath string) (*Server, error) {
-	serverState := ServerState{}
-
-	// load the data if found
-	serverStateData, err := ioutil.ReadFile(dataFilePath)
+func NewServer(clientID string, clientSecret string, store Store, sources []ForecastSource, history *History, outbox *Outbox, deadLetters *DeadLetters) (*Server, error) {
+	serverState, err := store.Load()
 	if err != nil {
-		// allow this error
-		log.WithFields(log.Fields{
-			"area": "db",
-		}).Warnf("Could not read JSON data file on start-up: %s", err)
-	} else {
-		if err := json.Unmarshal(serverStateData, &serverState); err != nil {
-			log.WithFields(log.Fields{
-				"area": "db",
-			}).Warnf("Could not unmarshal JSON data file on start-up: %s", err)
-		}
+		return nil, err
 	}
 
-	if serverState.Tokens == nil {
-		serverState.Tokens = make(map[string]*Account)
+	rekeyed := migrateServerState(serverState)
+
+	server := &Server{
+		clientID:            clientID,
+		clientSecret:        clientSecret,
+		sources:             sources,
+		history:             history,
+		outbox:              outbox,
+		deadLetters:         deadLetters,
+		responseURLPrefixes: []string{defaultResponseURLPrefix},
+		mutex:               sync.Mutex{},
+		store:               store,
+		outChan:             make(chan SlackMessage, 10000),
+		tweetChan:           make(chan Tweet, 100),
+		slackRateLimiter:    newSlackRateLimiter(),
+		slackWorkers:        defaultSlackWorkers,
+		quitChan:            make(chan interface{}),
+		runDone:             make(chan interface{}),
+		pollInterval:        defaultPollInterval,
+		eventPollInterval:   defaultEventPollInterval,
+		refreshChan:         make(chan struct{}, 1),
+		fetchBackOffs:       make(map[string]*fetchBackOff),
+		waitGroup:           sync.WaitGroup{},
+
+		serverState: serverState,
 	}
 
-	return &Server{
-		clientID:     clientID,
-		clientSecret: clientSecret,
-		mutex:        sync.Mutex{},
-		dataFilePath: dataFilePath,
-		outChan:      make(chan SlackMessage, 10000),
-		tweetChan:    make(chan Tweet, 100),
-		quitChan:     make(chan interface{}),
-		waitGroup:    sync.WaitGroup{},
+	if rekeyed {
+		log.WithFields(log.Fields{
+			"area": "db",
+		}).Infof("Migrating data file to per-channel accounts")
+		if err := server.saveServerData(); err != nil {
+			return nil, fmt.Errorf("Error saving migrated data file: %s", err)
+		}
+	}
 
-		serverState: &serverState,
-	}, nil
+	return server, nil
 }
 
 // SetTwitterAPI sets the optional Twitter API
@@ -92,96 +134,105 @@ func (s *Server) SetTwitterAPI(twitterAPI *anaconda.TwitterApi) {
 	s.twitterAPI = twitterAPI
 }
 
+// SetSlackVerification sets the secrets used to verify requests from Slack. If the signing secret
+// is empty, requests are checked against the legacy verification token.
+func (s *Server) SetSlackVerification(signingSecret string, verificationToken string) {
+	s.signingSecret = signingSecret
+	s.verificationToken = verificationToken
+}
+
+// SetResponseURLPrefixes overrides the URL prefixes slash command response URLs must match, for testing against a fake Slack
+func (s *Server) SetResponseURLPrefixes(prefixes []string) {
+	s.responseURLPrefixes = prefixes
+}
+
+// SetSlackWorkers sets how many Slack messages can be sent at once. Must be called before Run.
+func (s *Server) SetSlackWorkers(slackWorkers int) {
+	s.slackWorkers = slackWorkers
+}
+
+// SetAdminToken sets the token admin API requests must have. The admin API is switched off without one.
+func (s *Server) SetAdminToken(adminToken string) {
+	s.adminToken = adminToken
+}
+
+// SetPollIntervals sets how often we poll for changes, normally and during scheduled events
+func (s *Server) SetPollIntervals(pollInterval time.Duration, eventPollInterval time.Duration) {
+	s.pollInterval = pollInterval
+	s.eventPollInterval = eventPollInterval
+}
+
+// SetPublicURL sets the optional URL this server can be reached at, needed to attach charts to Slack messages
+func (s *Server) SetPublicURL(publicURL string) {
+	s.publicURL = publicURL
+}
+
 // save the server data - write lock should already be held
 func (s *Server) saveServerData() error {
-	jsonData, err := json.Marshal(s.serverState)
-	if err != nil {
-		return fmt.Errorf("Error marshalling server data: %s", err)
+	if err := s.store.Save(s.serverState); err != nil {
+		return err
 	}
 
-	backupFile := fmt.Sprintf("%s.%d", s.dataFilePath, time.Now().Unix())
-	if err := copyFileContents(s.dataFilePath, backupFile); err != nil {
-		// allow this error
+	// delivered notifications are now recorded on their accounts
+	if err := s.outbox.RemoveDelivered(); err != nil {
+		// allow this error - they'll be sent again on restart
 		log.WithFields(log.Fields{
-			"area": "db",
-		}).Errorf("Could not store data file: %s", err)
-	}
-
-	err = ioutil.WriteFile(s.dataFilePath, jsonData, 0644)
-	if err != nil {
-		return fmt.Errorf("Error writing data to file: %s", err)
+			"area": "outbox",
+		}).Errorf("Could not remove delivered notifications: %s", err)
 	}
 	return nil
 }
 
-// Run starts the service.
-func (s *Server) Run() {
+// Run starts the service, and polls for changes until ctx is cancelled. Queued work carries
+// on after it returns, until Shutdown.
+func (s *Server) Run(ctx context.Context) {
+	defer close(s.runDone)
 	rand.Seed(time.Now().UTC().UnixNano())
 
+	// stop taking requests from Slack as soon as we're asked to quit
+	go func() {
+		<-ctx.Done()
+		close(s.quitChan)
+	}()
+
 	// outgoing sender workers
+	go s.runSlackWorkers()
+
+	// notifications that weren't sent before we last stopped go out first
+	publishGauge("outbox_size", func() interface{} {
+		return s.outbox.Len()
+	})
+	publishGauge("dead_letters_size", func() interface{} {
+		return s.deadLetters.Len()
+	})
+	s.replayOutbox()
+
+	// delivered notifications are committed in batches, rather than saving once per channel
 	go func() {
-		for slackMessage := range s.outChan {
-			func() {
-				defer s.waitGroup.Done()
-				log.WithFields(slackMessage.logFields).Debugf("Sending message to channel")
-
-				// retry loop
-				attemptCount := 0
-				for {
-					attemptCount++
-					if err := s.sendTextMessage(slackMessage.url, slackMessage.message, slackMessage.quip); err != nil {
-						log.WithFields(slackMessage.logFields).Errorf("Error sending text message - retry attempt #%d/3: %s", attemptCount, err)
-						if attemptCount >= 3 {
-							return
-						}
-					} else {
-						log.WithFields(slackMessage.logFields).Infof("Sent message to channel")
-						return
-					}
-					time.Sleep(1 * time.Second)
-				}
-			}()
+		for sleepContext(ctx, outboxFlushInterval) {
+			s.flushOutbox()
 		}
 	}()
 
 	// outgoing tweet loop
 	go func() {
 		for tweet := range s.tweetChan {
-			func() {
-				defer s.waitGroup.Done()
-				log.WithFields(tweet.logFields).Infof("Sending tweet")
-
-				diffStr := ""
-				if tweet.percentChange != 0.0 {
-					diffStr = fmt.Sprintf(" (%+.1f%%)", tweet.percentChange)
-				}
-				tweetMsg := fmt.Sprintf("Chance of a #Trump apocalypse: %.1f%%%s - @realDonaldTrump https://projects.fivethirtyeight.com/2016-election-forecast",
-					tweet.percentNow, diffStr)
-
-				// retry loop
-				attemptCount := 0
-				for {
-					attemptCount++
-					if _, err := s.twitterAPI.PostTweet(tweetMsg, nil); err != nil {
-						log.WithFields(tweet.logFields).Errorf("Error sending Tweet - retry attempt #%d/3: %s", attemptCount, err)
-						if attemptCount >= 3 {
-							return
-						}
-					} else {
-						log.WithFields(tweet.logFields).Infof("Sent tweet")
-
-						// this will have to wait till 538 polling loop is done, but only one tweet is created per loop,
-						// and there's a 5 minute sleep between intervals
-						s.mutex.Lock()
-						s.serverState.LastTweetedValue = tweet.percentNow
-						s.saveServerData()
-						s.mutex.Unlock()
-						return
-					}
+			s.sendTweet(tweet)
+			s.waitGroup.Done()
+		}
+	}()
 
-					time.Sleep(5 * time.Second)
-				}
-			}()
+	// history compaction loop
+	go func() {
+		for {
+			if err := s.history.Compact(); err != nil {
+				log.WithFields(log.Fields{
+					"area": "history",
+				}).Errorf("Error compacting history: %s", err)
+			}
+			if !sleepContext(ctx, 24*time.Hour) {
+				return
+			}
 		}
 	}()
 
@@ -191,98 +242,155 @@ func (s *Server) Run() {
 			s.waitGroup.Add(1)
 			defer s.waitGroup.Done()
 
-			// check for quit
-			select {
-			case <-s.quitChan:
-				log.Infof("Received QUIT message from Run() - quitting")
+			// fetch from every source before taking the lock
+			fetched := []*Forecast{}
+			for _, source := range s.sources {
+				if !s.readyToFetch(source.Name(), time.Now()) {
+					log.WithFields(log.Fields{
+						"area":   "fetch",
+						"source": source.Name(),
+					}).Debugf("Backing off from %s", source.Name())
+					continue
+				}
+				forecast, err := source.Fetch()
+				if err != nil {
+					incrementMetric("fetch_failures")
+					retryAfter := s.fetchFailed(source.Name(), time.Now())
+					log.WithFields(log.Fields{
+						"area":   "fetch",
+						"source": source.Name(),
+					}).Errorf("Error fetching data from %s - trying again in %s: %s", source.Name(), retryAfter, err)
+					continue
+				}
+				s.fetchSucceeded(source.Name())
+				for model, modelForecast := range forecast.Models {
+					log.WithFields(log.Fields{
+						"area":   "data",
+						"source": forecast.Source,
+						"model":  model,
+						"value":  modelForecast.TrumpChance,
+					}).Debugf("Trump's chance fetched")
+				}
+				fetched = append(fetched, forecast)
+			}
+			if len(fetched) == 0 {
 				return
-			default:
 			}
 
-			trumpChance, err := fetchTrumpChance()
-			if err != nil {
-				log.WithFields(log.Fields{
-					"area": "fetch",
-				}).Errorf("Error fetching data from 538: %s", err)
-				return
+			for _, forecast := range fetched {
+				if err := s.history.Append(forecastHistoryPoints(forecast)); err != nil {
+					log.WithFields(log.Fields{
+						"area":   "history",
+						"source": forecast.Source,
+					}).Errorf("Error recording history: %s", err)
+				}
 			}
-			log.WithFields(log.Fields{
-				"area":  "data",
-				"value": trumpChance,
-			}).Debugf("Trump's chance fetched")
 
+			// messages and tweets are queued once the lock's released, since the senders need it
 			s.mutex.Lock()
-			defer s.mutex.Unlock()
-
-			s.currentValue = trumpChance
+			tweets := []Tweet{}
 			needToSave := false
+			fetchedSeries := make(map[string]bool)
+			for _, forecast := range fetched {
+				for model, modelForecast := range forecast.Models {
+					key := seriesKey(forecast.Source, model)
+					fetchedSeries[key] = true
+					if _, previous, ok := s.latestChance(key); !ok || previous != modelForecast.TrumpChance {
+						needToSave = true
+					}
+				}
+				s.serverState.Forecasts[forecast.Source] = forecast
+			}
 
 			if s.twitterAPI != nil {
-				if trumpChance != s.serverState.LastTweetedValue {
+				// only the default model of each source is tweeted
+				for _, key := range s.defaultSeries() {
+					if !fetchedSeries[key] {
+						continue
+					}
+					forecast, trumpChance, _ := s.latestChance(key)
+					lastTweetedValue := s.serverState.LastTweetedValues[forecast.Source]
+					if trumpChance == lastTweetedValue {
+						continue
+					}
+
 					var percentChange float32
-					if s.serverState.LastTweetedValue != 0.0 {
-						percentChange = trumpChance - s.serverState.LastTweetedValue
+					if lastTweetedValue != 0.0 {
+						percentChange = trumpChance - lastTweetedValue
 					}
 
 					tweet := Tweet{
+						source:        forecast.Source,
+						url:           forecast.URL,
+						chartKey:      key,
 						percentNow:    trumpChance,
 						percentChange: percentChange,
 						logFields: log.Fields{
+							"source":        forecast.Source,
 							"percentNow":    trumpChance,
 							"percentChange": percentChange,
 						},
 					}
 
-					s.waitGroup.Add(1)
-					s.tweetChan <- tweet
+					tweets = append(tweets, tweet)
 				}
 			}
 
-			// loop through each team to see if there's a change
-			for teamID := range s.serverState.Tokens {
-				team := s.serverState.Tokens[teamID]
-				if team.ReportedTrumpChance == trumpChance {
+			// loop through each installed channel to see if there's a change - each tracks what it's been told independently
+			messages := []*OutboxEntry{}
+			for key := range s.serverState.Tokens {
+				team := s.serverState.Tokens[key]
+				if team.Unsubscribed || team.Disabled {
+					continue
+				}
+
+				// compare against what the channel will have been told once its queued messages are sent
+				reportedTeam := s.outbox.PendingReported(key, team)
+				series := s.accountSeries(team)
+				lines := []string{}
+				for _, key := range series {
+					if !fetchedSeries[key] {
+						continue
+					}
+					forecast, modelForecast, _ := s.latestModel(key)
+					reported := reportedTeam.ReportedChances[key]
+					if reported == modelForecast.TrumpChance {
+						continue
+					}
+					label := seriesLabel(key, len(series))
+					lines = append(lines, chanceLine(label, modelForecast.TrumpChance, reported, forecast.URL))
+					lines = append(lines, projectionLines(key, label, modelForecast, reportedTeam.ReportedProjections)...)
+				}
+				if len(lines) == 0 {
 					log.WithFields(log.Fields{
 						"area":     "data",
 						"teamID":   team.TeamID,
 						"teamName": team.TeamName,
-						"value":    trumpChance,
 					}).Debugf("Trump's chance hasn't changed for team")
-					continue
+				} else {
+					// the values are recorded on the account once the message is delivered
+					reported := ReportedValues{
+						Chances:     make(map[string]float32),
+						Projections: make(map[string]float32),
+					}
+					for _, key := range series {
+						if _, modelForecast, ok := s.latestModel(key); ok {
+							reported.Chances[key] = modelForecast.TrumpChance
+							for projectionKey, value := range projectionValues(key, modelForecast) {
+								reported.Projections[projectionKey] = value
+							}
+						}
+					}
+					messages = append(messages, newTeamMessage(key, team, strings.Join(lines, "\n"), s.chartURL(series[0], notificationChartWindow, "png"), reported))
 				}
 
-				// build the +/- context string
-				contextStr := ""
-				if team.ReportedTrumpChance > 0 {
-					percentageChange := trumpChance - team.ReportedTrumpChance
-					contextStr = fmt.Sprintf(" (%+.1f%%)", percentageChange)
-				}
-				msg := fmt.Sprintf("Chance of a Trump apocalypse: %.1f%%%s https://projects.fivethirtyeight.com/2016-election-forecast", trumpChance, contextStr)
-				quip := randomQuip()
-				logFields := log.Fields{
-					"area":        "slack",
-					"teamID":      team.TeamID,
-					"teamName":    team.TeamName,
-					"channelID":   team.IncomingWebhook.ChannelID,
-					"channelName": team.IncomingWebhook.ChannelName,
-					"message":     msg,
-					"quip":        quip,
-					"value":       trumpChance,
+				// watched states get their own message
+				stateLines, reportedStates := s.watchedStateChanges(reportedTeam, series, fetchedSeries)
+				if len(stateLines) > 0 {
+					messages = append(messages, newTeamMessage(key, team, strings.Join(stateLines, "\n"), "", ReportedValues{States: reportedStates}))
 				}
-
-				// queue up the outgoing message
-				s.waitGroup.Add(1)
-				s.outChan <- SlackMessage{
-					url:       s.serverState.Tokens[teamID].IncomingWebhook.URL,
-					message:   msg,
-					quip:      quip,
-					logFields: logFields,
-				}
-
-				// for simplicity, assume the message does get sent, and update the database now
-				needToSave = true
-				team.ReportedTrumpChance = trumpChance
 			}
+			slackMessages := s.storeTeamMessages(messages)
 
 			if needToSave {
 				log.WithFields(log.Fields{
@@ -295,37 +403,332 @@ func (s *Server) Run() {
 					}).Errorf("Error saving token data: %s", err)
 				}
 			}
+			s.mutex.Unlock()
+
+			for _, tweet := range tweets {
+				s.waitGroup.Add(1)
+				s.tweetChan <- tweet
+			}
+			s.queueSlackMessages(slackMessages)
 		}()
 
-		time.Sleep(5 * time.Minute)
+		if !s.waitToPoll(ctx) {
+			log.Infof("Stopped polling for changes")
+			return
+		}
 	}
 }
 
-// Stop running
-func (s *Server) Stop() {
-	s.waitGroup.Wait()
+// how long to wait between attempts to send a tweet
+var _tweetRetryInterval = 5 * time.Second
+
+// sendTweet tweets a change, with a chart if we can make one, retrying a couple of times before it's
+// stored as a dead letter
+func (s *Server) sendTweet(tweet Tweet) {
+	log.WithFields(tweet.logFields).Infof("Sending tweet")
+
+	diffStr := ""
+	if tweet.percentChange != 0.0 {
+		diffStr = fmt.Sprintf(" (%+.1f%%)", tweet.percentChange)
+	}
+	tweetMsg := fmt.Sprintf("Chance of a #Trump apocalypse: %.1f%%%s - @realDonaldTrump %s",
+		tweet.percentNow, diffStr, tweet.url)
+
+	// attach a chart, if we can - the tweet's still worth sending without one
+	params := url.Values{}
+	if chartData, err := s.chartPNGBase64(tweet.chartKey); err != nil {
+		log.WithFields(tweet.logFields).Warnf("Not attaching chart to tweet: %s", err)
+	} else if media, err := s.twitterAPI.UploadMedia(chartData); err != nil {
+		log.WithFields(tweet.logFields).Warnf("Error uploading chart for tweet: %s", err)
+	} else {
+		params.Set("media_ids", media.MediaIDString)
+	}
+
+	// retry loop
+	attemptCount := 0
+	for {
+		attemptCount++
+		if _, err := s.twitterAPI.PostTweet(tweetMsg, params); err != nil {
+			log.WithFields(tweet.logFields).Errorf("Error sending Tweet - retry attempt #%d/3: %s", attemptCount, err)
+			if attemptCount >= 3 {
+				s.deadLetterTweet(tweet, attemptCount, err)
+				return
+			}
+		} else {
+			log.WithFields(tweet.logFields).Infof("Sent tweet")
+			if tweet.retried {
+				return
+			}
+
+			// this will have to wait till 538 polling loop is done, but only one tweet is created per loop,
+			// and there's a 5 minute sleep between intervals
+			s.mutex.Lock()
+			s.serverState.LastTweetedValues[tweet.source] = tweet.percentNow
+			s.saveServerData()
+			s.mutex.Unlock()
+			return
+		}
+
+		time.Sleep(_tweetRetryInterval)
+	}
+}
+
+// sleepContext sleeps for the duration, or until ctx is cancelled. Returns false if it was cancelled.
+func sleepContext(ctx context.Context, duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// stopping returns whether we've been asked to quit
+func (s *Server) stopping() bool {
+	select {
+	case <-s.quitChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// startWork adds work for Shutdown to wait for, which must be finished with waitGroup.Done. Returns
+// false if Shutdown's already waiting, in which case nothing more can be queued.
+func (s *Server) startWork() bool {
+	s.stopMutex.Lock()
+	defer s.stopMutex.Unlock()
+
+	if s.stopped {
+		return false
+	}
+	s.waitGroup.Add(1)
+	return true
+}
+
+// newTeamMessage returns a message to a team's channel, with a random quip and an optional image
+func newTeamMessage(key string, team *Account, msg string, imageURL string, reported ReportedValues) *OutboxEntry {
+	return &OutboxEntry{
+		AccountKey: key,
+		URL:        team.IncomingWebhook.URL,
+		Message:    msg,
+		Quip:       randomQuip(),
+		ImageURL:   imageURL,
+		QueuedAt:   time.Now(),
+		Reported:   reported,
+	}
+}
+
+// storeTeamMessages stores messages to teams' channels in the outbox together, and returns them to be
+// queued once the lock's released. The values each reports are recorded on its account once it's
+// delivered - lock should already be held.
+func (s *Server) storeTeamMessages(messages []*OutboxEntry) []SlackMessage {
+	err := s.outbox.Add(messages)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"area":     "outbox",
+			"messages": len(messages),
+		}).Errorf("Error storing messages in outbox: %s", err)
+	}
+	slackMessages := make([]SlackMessage, 0, len(messages))
+	for _, entry := range messages {
+		team := s.serverState.Tokens[entry.AccountKey]
+		if err != nil {
+			// still send it, but it won't survive a restart, so assume it gets sent like we used to
+			entry.Reported.applyTo(team)
+		}
+		slackMessages = append(slackMessages, outboxSlackMessage(entry, teamLogFields(team, entry.Message, entry.Quip)))
+	}
+	return slackMessages
+}
+
+// queueSlackMessages queues messages for the Slack workers - the lock mustn't be held, since the
+// workers take it when they finish a message
+func (s *Server) queueSlackMessages(slackMessages []SlackMessage) {
+	for _, slackMessage := range slackMessages {
+		s.waitGroup.Add(1)
+		s.outChan <- slackMessage
+	}
+}
+
+// outboxSlackMessage returns the message to send for an outbox entry
+func outboxSlackMessage(entry *OutboxEntry, logFields log.Fields) SlackMessage {
+	return SlackMessage{
+		queuedAt:   entry.QueuedAt,
+		accountKey: entry.AccountKey,
+		url:        entry.URL,
+		message:    entry.Message,
+		quip:       entry.Quip,
+		imageURL:   entry.ImageURL,
+		outboxID:   entry.ID,
+		logFields:  logFields,
+	}
+}
+
+// replayOutbox queues the notifications that weren't sent before we last stopped
+func (s *Server) replayOutbox() {
+	s.mutex.Lock()
+	slackMessages := []SlackMessage{}
+	for _, entry := range s.outbox.Pending() {
+		team, ok := s.serverState.Tokens[entry.AccountKey]
+		if !ok || team.Unsubscribed || team.Disabled || team.IncomingWebhook.URL != entry.URL || entry.Reported.recordedOn(team) {
+			// uninstalled, reinstalled, or paused since it was queued - or it was sent and saved, but
+			// we stopped before removing it
+			if err := s.outbox.Remove(entry.ID); err != nil {
+				log.WithFields(log.Fields{
+					"area":    "outbox",
+					"account": entry.AccountKey,
+				}).Errorf("Error removing stale notification: %s", err)
+			}
+			continue
+		}
+
+		logFields := teamLogFields(team, entry.Message, entry.Quip)
+		log.WithFields(logFields).Infof("Replaying notification from outbox")
+		slackMessages = append(slackMessages, outboxSlackMessage(entry, logFields))
+	}
+	s.mutex.Unlock()
+
+	s.queueSlackMessages(slackMessages)
+}
+
+// finishSlackMessage records how sending a message from the outbox went. A delivered message's
+// values are recorded on its account, and committed with the next save. A failed message is dropped
+// without recording them, so the next change is reported against what the channel last saw.
+func (s *Server) finishSlackMessage(slackMessage SlackMessage, delivered bool) {
+	if slackMessage.outboxID == "" {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !delivered {
+		if err := s.outbox.Remove(slackMessage.outboxID); err != nil {
+			log.WithFields(slackMessage.logFields).Errorf("Error removing failed notification from outbox: %s", err)
+		}
+		return
+	}
+	entry, ok := s.outbox.Delivered(slackMessage.outboxID)
+	if !ok {
+		return
+	}
+	if team, ok := s.serverState.Tokens[entry.AccountKey]; ok {
+		entry.Reported.applyTo(team)
+	}
+}
+
+// flushOutbox saves the values of delivered notifications, if there are any
+func (s *Server) flushOutbox() {
+	if s.outbox.DeliveredCount() == 0 {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.saveServerData(); err != nil {
+		log.WithFields(log.Fields{
+			"area": "db",
+		}).Errorf("Error saving delivered notifications: %s", err)
+	}
+}
+
+// teamLogFields returns the fields to log a message to a team's channel with
+func teamLogFields(team *Account, msg string, quip string) log.Fields {
+	return log.Fields{
+		"area":        "slack",
+		"teamID":      team.TeamID,
+		"teamName":    team.TeamName,
+		"channelID":   team.IncomingWebhook.ChannelID,
+		"channelName": team.IncomingWebhook.ChannelName,
+		"message":     msg,
+		"quip":        quip,
+	}
+}
+
+// Shutdown waits for Run to return and for queued messages and tweets to be sent, then saves the data
+// file. If ctx is done first, it stops waiting - unsent notifications stay in the outbox for next time,
+// and unsent tweets are dropped. HTTP requests should already have been stopped.
+func (s *Server) Shutdown(ctx context.Context) error {
+	select {
+	case <-s.runDone:
+	case <-ctx.Done():
+		return fmt.Errorf("Error waiting for polling to stop: %s", ctx.Err())
+	}
+
+	// anything that gets in before this is waited for, and anything after is turned away
+	s.stopMutex.Lock()
+	s.stopped = true
+	s.stopMutex.Unlock()
+
+	drained := make(chan interface{})
+	go func() {
+		s.waitGroup.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+		// nothing else can be queued, so let the senders finish
+		close(s.outChan)
+		close(s.tweetChan)
+	case <-ctx.Done():
+		err = fmt.Errorf("Error waiting for queued messages: %s - %d notifications left in the outbox", ctx.Err(), s.outbox.Len())
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if saveErr := s.saveServerData(); saveErr != nil {
+		return fmt.Errorf("Error saving data file: %s", saveErr)
+	}
+	if closeErr := s.history.Close(); closeErr != nil {
+		return fmt.Errorf("Error closing history: %s", closeErr)
+	}
+	return err
 }
 
 // send a Slack text message to a team's channel
-func (s *Server) sendTextMessage(url string, body string, quip string) error {
+func (s *Server) sendTextMessage(url string, body string, quip string, imageURL string) error {
 	msg := SlackTextMessage{
 		ResponseType: "in_channel",
 		Text:         body,
-		Attachments: []SlackTextAttachment{
-			SlackTextAttachment{
-				Text: quip,
-			},
-		},
+		Attachments:  []SlackTextAttachment{},
+	}
+	if quip != "" {
+		msg.Attachments = append(msg.Attachments, SlackTextAttachment{
+			Text: quip,
+		})
+	}
+	if imageURL != "" {
+		msg.Attachments = append(msg.Attachments, SlackTextAttachment{
+			Fallback: "Forecast chart",
+			ImageURL: imageURL,
+		})
 	}
+	// errors are returned as-is, so HTTP errors can be classified
 	respBytes, err := postJSON(url, msg)
 	if err != nil {
-		return fmt.Errorf("Error posting JSON to %s: %s", url, err)
+		return err
 	}
 	log.Debugf("Sent text message - response: %s", string(respBytes))
 
 	return nil
 }
 
+// writeRestartingResponse tells whoever ran /trump to try again once we've restarted
+func writeRestartingResponse(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SlackTextMessage{
+		ResponseType: "ephemeral",
+		Text:         "The bot is restarting. Please try again in a minute.",
+	})
+}
+
 func (s *Server) handleTrump(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
 		log.WithFields(log.Fields{
@@ -335,7 +738,6 @@ func (s *Server) handleTrump(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token := r.PostFormValue("token")
 	team := r.PostFormValue("team_id")
 	teamDomain := r.PostFormValue("team_domain")
 	channelID := r.PostFormValue("channel_id")
@@ -348,7 +750,6 @@ func (s *Server) handleTrump(w http.ResponseWriter, r *http.Request) {
 
 	logFields := log.Fields{
 		"request":      "/trump",
-		"token":        token,
 		"team":         team,
 		"team_domain":  teamDomain,
 		"channel_id":   channelID,
@@ -360,52 +761,151 @@ func (s *Server) handleTrump(w http.ResponseWriter, r *http.Request) {
 		"response_url": responseURL,
 	}
 
-	s.mutex.Lock()
-	currentValue := s.currentValue
-	s.mutex.Unlock()
-
 	log.WithFields(logFields).Info("Received /trump request")
 
-	// respond immediately with "in_channel" to tell Slack to show the original /trump command
-	w.Header().Set("Content-Type", "application/json")
-	if _, err := w.Write([]byte(`{"response_type": "in_channel"}`)); err != nil {
-		log.WithFields(logFields).Errorf("Error writing response_type:in_channel JSON: %s", err)
-		http.Error(w, "error", http.StatusInternalServerError)
+	if s.stopping() {
+		writeRestartingResponse(w)
 		return
 	}
 
-	// send the response in a separate request to avoid scrolling issues in Slack
-	s.waitGroup.Add(1)
-	go func() {
-		time.Sleep(500 * time.Millisecond)
-		s.outChan <- SlackMessage{
-			url:       responseURL,
-			message:   fmt.Sprintf("Chance of a Trump apocalypse: %.1f%% https://projects.fivethirtyeight.com/2016-election-forecast", currentValue),
-			quip:      randomQuip(),
-			logFields: logFields,
+	// never relay to anything but Slack
+	if err := validateResponseURL(responseURL, s.responseURLPrefixes); err != nil {
+		incrementMetric("rejected_response_urls")
+		log.WithFields(logFields).Warnf("Rejected /trump request: %s", err)
+		http.Error(w, "invalid response_url", http.StatusBadRequest)
+		return
+	}
+
+	resp := s.dispatchSlashCommand(text, &slashRequest{
+		teamID:      team,
+		channelID:   channelID,
+		userName:    userName,
+		responseURL: responseURL,
+		logFields:   logFields,
+	})
+
+	responseType := "ephemeral"
+	if resp.inChannel {
+		responseType = "in_channel"
+	}
+
+	if resp.delayed {
+		// the delayed response has to be queued before Shutdown stops waiting for work
+		if !s.startWork() {
+			writeRestartingResponse(w)
+			return
 		}
-	}()
+
+		// respond immediately to tell Slack whether to show the original /trump command
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write([]byte(fmt.Sprintf(`{"response_type": "%s"}`, responseType))); err != nil {
+			log.WithFields(logFields).Errorf("Error writing response_type:%s JSON: %s", responseType, err)
+			http.Error(w, "error", http.StatusInternalServerError)
+			s.waitGroup.Done()
+			return
+		}
+
+		// send the response in a separate request to avoid scrolling issues in Slack
+		go func() {
+			time.Sleep(500 * time.Millisecond)
+			s.outChan <- SlackMessage{
+				queuedAt:  time.Now(),
+				url:       responseURL,
+				message:   resp.text,
+				quip:      resp.quip,
+				logFields: logFields,
+			}
+		}()
+		return
+	}
+
+	msg := SlackTextMessage{
+		ResponseType: responseType,
+		Text:         resp.text,
+	}
+	if resp.quip != "" {
+		msg.Attachments = []SlackTextAttachment{{Text: resp.quip}}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(msg); err != nil {
+		log.WithFields(logFields).Errorf("Error writing %s JSON: %s", responseType, err)
+	}
+}
+
+// Slack permissions the bot asks for when it's installed
+const oauthScopes = "incoming-webhook,commands"
+
+// handleInstall starts installing the bot, by sending the user to Slack with a signed state
+// that handleOAuth checks when Slack sends them back
+func (s *Server) handleInstall(w http.ResponseWriter, r *http.Request) {
+	state, err := newOAuthState(s.clientSecret, time.Now())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"area": "oauth",
+		}).Errorf("Error generating OAuth state: %s", err)
+		renderInstallError(w, http.StatusInternalServerError, "We couldn't start the install. Please try again.")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    state,
+		Path:     "/oauth",
+		MaxAge:   int(oauthStateMaxAge / time.Second),
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		HttpOnly: true,
+	})
+
+	params := url.Values{}
+	params.Add("client_id", s.clientID)
+	params.Add("scope", oauthScopes)
+	params.Add("state", state)
+	http.Redirect(w, r, "https://slack.com/oauth/authorize?"+params.Encode(), http.StatusFound)
 }
 
 // handle incoming OAuth requests
 func (s *Server) handleOAuth(w http.ResponseWriter, r *http.Request) {
-	select {
-	case <-s.quitChan:
-		w.Write([]byte("Please try again later"))
+	if s.stopping() {
+		renderPage(w, http.StatusServiceUnavailable, page{
+			Title:   "Please try again later",
+			Message: "The bot is restarting. Please try again in a minute.",
+		})
 		return
-	default:
 	}
 
+	logFields := log.Fields{
+		"area": "oath",
+	}
+
+	// make sure this browser started the install at /install, recently
+	state := r.URL.Query().Get("state")
+	if err := verifyOAuthState(s.clientSecret, state, time.Now()); err != nil {
+		log.WithFields(logFields).Warnf("Rejected OAuth request: %s", err)
+		renderInstallError(w, http.StatusBadRequest, "Your install link has expired or isn't valid.")
+		return
+	}
+	if cookie, err := r.Cookie(oauthStateCookie); err != nil || !hmac.Equal([]byte(cookie.Value), []byte(state)) {
+		log.WithFields(logFields).Warnf("Rejected OAuth request: state doesn't match cookie")
+		renderInstallError(w, http.StatusBadRequest, "Please finish installing the bot in the same browser you started in.")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Path: "/oauth", MaxAge: -1})
+
 	if errorReason := r.URL.Query().Get("error"); errorReason == "access_denied" {
 		// user clicked "Cancel"
-		w.Write([]byte("Maybe next time!"))
+		renderPage(w, http.StatusOK, page{
+			Title:    "Maybe next time!",
+			Message:  "The bot wasn't added to your Slack channel.",
+			LinkURL:  "/install",
+			LinkText: "Changed your mind?",
+		})
 		return
 	}
 
 	oauthCode := r.URL.Query().Get("code")
 	if oauthCode == "" {
-		log.Errorf("Error: handleOAuth missing 'code'")
-		http.Error(w, "Error", http.StatusBadRequest)
+		log.WithFields(logFields).Errorf("Error: handleOAuth missing 'code'")
+		renderInstallError(w, http.StatusBadRequest, "Slack didn't send us an authorization code.")
 		return
 	}
 
@@ -416,47 +916,46 @@ func (s *Server) handleOAuth(w http.ResponseWriter, r *http.Request) {
 	params.Add("code", oauthCode)
 	requestStr := params.Encode()
 
-	logFields := log.Fields{
-		"area": "oath",
-	}
-
 	respBytes, err := postRequest(oauthURL, requestStr)
 	log.WithFields(logFields).Debugf("Posting to %s", oauthURL)
 	if err != nil {
 		log.WithFields(logFields).Errorf("Error posting to %s: %s", oauthURL, err)
-		http.Error(w, "Error", http.StatusBadRequest)
+		renderInstallError(w, http.StatusBadGateway, "We couldn't reach Slack to finish the install.")
 		return
 	}
 
-	log.WithFields(logFields).Debugf("oauth response: %s", string(respBytes))
-
 	oauthResponse := Account{}
 	err = json.Unmarshal(respBytes, &oauthResponse)
 	if err != nil {
 		log.WithFields(logFields).Errorf("Error unmarshalling Account: %s", err)
-		http.Error(w, "Error", http.StatusInternalServerError)
+		renderInstallError(w, http.StatusInternalServerError, "Slack sent us a response we didn't understand.")
 		return
 	}
 	if oauthResponse.AccessToken == "" {
 		log.WithFields(logFields).Errorf("Empty AccessToken")
-		http.Error(w, "Error", http.StatusInternalServerError)
+		renderInstallError(w, http.StatusInternalServerError, "Slack didn't give us access to your channel.")
 		return
 	}
 	if oauthResponse.TeamID == "" {
 		log.WithFields(logFields).Errorf("Empty TeamID")
-		http.Error(w, "Error", http.StatusInternalServerError)
+		renderInstallError(w, http.StatusInternalServerError, "Slack didn't tell us which team you're on.")
 		return
 	}
+	migrateAccount(&oauthResponse)
 
 	s.mutex.Lock()
-	s.serverState.Tokens[oauthResponse.TeamID] = &oauthResponse
+	// installing into another channel adds to the team's installations, but reinstalling into a channel replaces it
+	s.serverState.Tokens[accountKey(oauthResponse.TeamID, oauthResponse.IncomingWebhook.ChannelID)] = &oauthResponse
 	if err := s.saveServerData(); err != nil {
 		// allow
 		log.WithFields(logFields).Errorf("Error saving token data: %s", err)
 	}
 	s.mutex.Unlock()
 
-	log.WithFields(logFields).Infof("Successfully received access token: %s with method %s", oauthResponse.AccessToken, oauthResponse.Scope)
+	log.WithFields(logFields).WithFields(log.Fields{
+		"teamID":      oauthResponse.TeamID,
+		"channelName": oauthResponse.IncomingWebhook.ChannelName,
+	}).Infof("Successfully installed with scope %s", oauthResponse.Scope)
 
 	http.Redirect(w, r, oauthResponse.IncomingWebhook.ConfigurationURL, http.StatusTemporaryRedirect)
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+// slackDeliveryResult says what to do after trying to send a message to Slack
+type slackDeliveryResult int
+
+const (
+	slackDelivered slackDeliveryResult = iota // 200 ok
+	slackRetry                                // worth trying again: rate limited, Slack's having trouble, or the network is
+	slackPermanent                            // the webhook is gone for good: no_service, channel_is_archived, action_prohibited, ...
+	slackRejected                             // Slack won't take this message, ex: invalid_payload - not worth retrying, but the webhook's fine
+)
+
+// _slackWebhookGone are Slack's error codes that mean a webhook is gone for good, and the status each comes with
+var _slackWebhookGone = map[string]int{
+	"action_prohibited":   http.StatusForbidden,
+	"no_service":          http.StatusNotFound,
+	"channel_not_found":   http.StatusNotFound,
+	"channel_is_archived": http.StatusGone,
+}
+
+// classifySlackError decides whether a failed send is worth retrying. For failures that aren't, it also
+// returns the reason, which is Slack's error code when it sent one.
+func classifySlackError(err error) (slackDeliveryResult, string) {
+	if err == nil {
+		return slackDelivered, ""
+	}
+
+	httpErr, ok := err.(*HTTPError)
+	if !ok {
+		// transport error
+		return slackRetry, ""
+	}
+
+	switch {
+	case httpErr.StatusCode == http.StatusTooManyRequests, httpErr.StatusCode >= 500:
+		return slackRetry, ""
+	case httpErr.StatusCode >= 400:
+		reason := httpErr.Body
+		if reason == "" || len(reason) > 100 {
+			reason = fmt.Sprintf("http_%d", httpErr.StatusCode)
+		}
+		if _slackWebhookGone[reason] == httpErr.StatusCode {
+			return slackPermanent, reason
+		}
+		// 400 invalid_payload, invalid_attachments, and friends - probably our fault, so the webhook's left alone
+		return slackRejected, reason
+	default:
+		return slackRetry, ""
+	}
+}
+
+// disableAccount stops sending to an account whose webhook failed permanently. It stays disabled
+// until the bot's reinstalled into the channel.
+func (s *Server) disableAccount(key string, reason string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	account, ok := s.serverState.Tokens[key]
+	if !ok || account.Disabled {
+		return
+	}
+
+	now := time.Now()
+	account.Disabled = true
+	account.DisabledReason = reason
+	account.DisabledAt = &now
+
+	logFields := log.Fields{
+		"area":     "slack",
+		"account":  key,
+		"teamName": account.TeamName,
+		"reason":   reason,
+	}
+	log.WithFields(logFields).Warnf("Disabling account after a permanent delivery failure")
+	incrementMetric("disabled_accounts")
+
+	if err := s.saveServerData(); err != nil {
+		log.WithFields(logFields).Errorf("Error saving token data: %s", err)
+	}
+}
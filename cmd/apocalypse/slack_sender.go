@@ -0,0 +1,283 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/azr/backoff"
+	"sync"
+	"time"
+)
+
+// how many Slack messages are sent at once, unless configured otherwise
+const defaultSlackWorkers = 8
+
+// Slack allows about one message per second to each webhook
+const slackWebhookRate = time.Second
+
+// give up on a Slack message after this many tries
+const maxSlackAttempts = 5
+
+// longest we'll wait when Slack asks us to slow down with Retry-After
+const maxSlackRetryAfter = 5 * time.Minute
+
+// slackRateLimiter limits how fast we send to each Slack URL. It just records when each URL can next be
+// sent to, rather than keeping a tokenbucket.Bucket per URL, since every bucket starts a goroutine that's
+// never stopped - we'd leak one for each webhook we've ever sent to.
+type slackRateLimiter struct {
+	mutex     sync.Mutex
+	next      map[string]time.Time // by URL - the earliest we can send to it again
+	lastSweep time.Time
+}
+
+// newSlackRateLimiter returns a new slackRateLimiter
+func newSlackRateLimiter() *slackRateLimiter {
+	return &slackRateLimiter{
+		next: make(map[string]time.Time),
+	}
+}
+
+// reserve claims a send to the URL and returns 0 if it's allowed now. Otherwise, it returns how long
+// until it will be, without claiming anything. The first send to a URL is always allowed.
+func (l *slackRateLimiter) reserve(url string) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+	if next, ok := l.next[url]; ok && next.After(now) {
+		return next.Sub(now)
+	}
+	l.next[url] = now.Add(slackWebhookRate)
+	return 0
+}
+
+// sweep forgets the URLs we're already allowed to send to again, at most once per interval, so
+// the map only holds the URLs sent to recently - lock should already be held
+func (l *slackRateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < slackWebhookRate {
+		return
+	}
+	l.lastSweep = now
+	for url, next := range l.next {
+		if !next.After(now) {
+			delete(l.next, url)
+		}
+	}
+}
+
+// newSlackBackOff returns the exponential back-off, with jitter, used between retries
+func newSlackBackOff() *backoff.ExponentialBackOff {
+	b := backoff.NewExponential()
+	b.InitialInterval = 1 * time.Second
+	b.MaxInterval = 1 * time.Minute
+	b.Reset()
+	return b
+}
+
+// slackQueue holds the messages waiting for the Slack workers, by URL. Queueing never blocks, and
+// each URL is only handed to one worker at a time, so its messages are delivered in the order they
+// were queued, while a slow webhook only holds up its own messages.
+type slackQueue struct {
+	mutex     sync.Mutex
+	ready     *sync.Cond
+	pending   map[string][]SlackMessage // by URL - messages that haven't been finished, oldest first
+	readyURLs []string                  // URLs with pending messages that no worker has
+	size      int
+	closed    bool
+}
+
+// newSlackQueue returns a new, empty slackQueue
+func newSlackQueue() *slackQueue {
+	q := &slackQueue{
+		pending: make(map[string][]SlackMessage),
+	}
+	q.ready = sync.NewCond(&q.mutex)
+	return q
+}
+
+// push adds a message to the end of its URL's queue
+func (q *slackQueue) push(slackMessage SlackMessage) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	queued := q.pending[slackMessage.url]
+	q.pending[slackMessage.url] = append(queued, slackMessage)
+	q.size++
+	if len(queued) == 0 {
+		// otherwise, it's already waiting for a worker, or a worker has it
+		q.readyURLs = append(q.readyURLs, slackMessage.url)
+		q.ready.Signal()
+	}
+}
+
+// next blocks until a URL is ready, and returns its oldest message. The URL belongs to the caller until
+// it calls done. Returns false once the queue's closed and there's nothing ready.
+func (q *slackQueue) next() (SlackMessage, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for len(q.readyURLs) == 0 {
+		if q.closed {
+			return SlackMessage{}, false
+		}
+		q.ready.Wait()
+	}
+	url := q.readyURLs[0]
+	q.readyURLs = q.readyURLs[1:]
+	return q.pending[url][0], true
+}
+
+// done removes the oldest message for a URL that was returned by next, and hands the URL to
+// another worker if there are more
+func (q *slackQueue) done(url string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	queued := q.pending[url][1:]
+	q.size--
+	if len(queued) == 0 {
+		delete(q.pending, url)
+		return
+	}
+	q.pending[url] = queued
+	q.readyURLs = append(q.readyURLs, url)
+	q.ready.Signal()
+}
+
+// retry puts back a message returned by next, and hands its URL to a worker again once the delay's
+// passed. No worker waits on it in the meantime.
+func (q *slackQueue) retry(slackMessage SlackMessage, delay time.Duration) {
+	q.mutex.Lock()
+	q.pending[slackMessage.url][0] = slackMessage
+	q.mutex.Unlock()
+
+	time.AfterFunc(delay, func() {
+		q.mutex.Lock()
+		defer q.mutex.Unlock()
+
+		q.readyURLs = append(q.readyURLs, slackMessage.url)
+		q.ready.Signal()
+	})
+}
+
+// close wakes the workers waiting on next, so they can return once there's nothing left that's ready
+func (q *slackQueue) close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.closed = true
+	q.ready.Broadcast()
+}
+
+// Len returns how many messages haven't been finished
+func (q *slackQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.size
+}
+
+// runSlackWorkers sends queued Slack messages in parallel until outChan is closed. Messages are moved
+// from outChan to a slackQueue as soon as they arrive, so a stalled webhook never stops the others, and
+// messages that have to wait - for the rate limit, or to be retried - are parked there, rather than
+// holding up a worker.
+func (s *Server) runSlackWorkers() {
+	queue := newSlackQueue()
+	workers := sync.WaitGroup{}
+	for i := 0; i < s.slackWorkers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for {
+				slackMessage, ok := queue.next()
+				if !ok {
+					return
+				}
+				// slash command response URLs are each used once, so only installed webhooks are limited
+				if slackMessage.accountKey != "" {
+					if wait := s.slackRateLimiter.reserve(slackMessage.url); wait > 0 {
+						queue.retry(slackMessage, wait)
+						continue
+					}
+				}
+
+				finished, delivered, retryIn := s.attemptSlackMessage(&slackMessage)
+				if !finished {
+					queue.retry(slackMessage, retryIn)
+					continue
+				}
+				queue.done(slackMessage.url)
+				s.finishSlackMessage(slackMessage, delivered)
+				s.waitGroup.Done()
+			}
+		}()
+	}
+
+	publishGauge("slack_queue_depth", func() interface{} {
+		return len(s.outChan) + queue.Len()
+	})
+
+	for slackMessage := range s.outChan {
+		queue.push(slackMessage)
+	}
+	queue.close()
+	workers.Wait()
+}
+
+// attemptSlackMessage makes one attempt to send a message. Returns whether it's finished with - it was
+// sent, it failed permanently, or we've run out of attempts - and if not, how long to wait before
+// trying again.
+func (s *Server) attemptSlackMessage(slackMessage *SlackMessage) (finished bool, delivered bool, retryIn time.Duration) {
+	if slackMessage.attempts == 0 {
+		log.WithFields(slackMessage.logFields).Debugf("Sending message to channel")
+	}
+	slackMessage.attempts++
+	attemptCount := slackMessage.attempts
+
+	err := s.sendTextMessage(slackMessage.url, slackMessage.message, slackMessage.quip, slackMessage.imageURL)
+	result, reason := classifySlackError(err)
+	switch result {
+	case slackDelivered:
+		log.WithFields(slackMessage.logFields).Infof("Sent message to channel")
+		incrementMetric("slack_sent")
+		if !slackMessage.queuedAt.IsZero() {
+			observeDuration("slack_delivery", time.Since(slackMessage.queuedAt))
+		}
+		return true, true, 0
+	case slackPermanent:
+		log.WithFields(slackMessage.logFields).Errorf("Permanent error sending text message: %s", err)
+		incrementMetric("slack_failed")
+		s.deadLetterSlackMessage(*slackMessage, attemptCount, err, reason)
+		if slackMessage.accountKey != "" {
+			s.disableAccount(slackMessage.accountKey, reason)
+		}
+		return true, false, 0
+	case slackRejected:
+		log.WithFields(slackMessage.logFields).Errorf("Slack rejected text message: %s", err)
+		incrementMetric("slack_failed")
+		s.deadLetterSlackMessage(*slackMessage, attemptCount, err, reason)
+		return true, false, 0
+	}
+
+	log.WithFields(slackMessage.logFields).Errorf("Error sending text message - retry attempt #%d/%d: %s", attemptCount, maxSlackAttempts, err)
+	if attemptCount >= maxSlackAttempts {
+		incrementMetric("slack_failed")
+		s.deadLetterSlackMessage(*slackMessage, attemptCount, err, "")
+		return true, false, 0
+	}
+
+	// Slack tells us how long to wait when we're rate limited
+	if httpErr, ok := err.(*HTTPError); ok && httpErr.RetryAfter > 0 {
+		retryAfter := httpErr.RetryAfter
+		if retryAfter > maxSlackRetryAfter {
+			retryAfter = maxSlackRetryAfter
+		}
+		incrementMetric("slack_rate_limited")
+		return false, false, retryAfter
+	}
+	if slackMessage.retryBackOff == nil {
+		slackMessage.retryBackOff = newSlackBackOff()
+	}
+	retryIn = slackMessage.retryBackOff.GetSleepTime()
+	slackMessage.retryBackOff.IncrementCurrentInterval()
+	return false, false, retryIn
+}
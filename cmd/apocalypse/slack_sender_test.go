@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// stallingSlack answers every request with "ok", except that requests to one URL wait until it's
+// released, and the first request to another is asked to come back in a second
+type stallingSlack struct {
+	stalledURL     string
+	release        chan interface{}
+	rateLimitedURL string
+
+	mutex       sync.Mutex
+	delivered   map[string]int // by URL
+	order       []string       // URLs, in the order they were delivered to
+	rateLimited bool
+}
+
+func (f *stallingSlack) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	if req.URL.String() == f.stalledURL {
+		<-f.release
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if req.URL.String() == f.rateLimitedURL && !f.rateLimited {
+		f.rateLimited = true
+		return &http.Response{
+			StatusCode: http.StatusTooManyRequests,
+			Header:     http.Header{"Retry-After": []string{"1"}},
+			Body:       ioutil.NopCloser(strings.NewReader("rate_limited")),
+			Request:    req,
+		}, nil
+	}
+	f.delivered[req.URL.String()]++
+	f.order = append(f.order, req.URL.String())
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader("ok")),
+		Request:    req,
+	}, nil
+}
+
+// deliveredTo returns how many messages have been delivered to a URL
+func (f *stallingSlack) deliveredTo(url string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.delivered[url]
+}
+
+func TestSlackWorkersDeliverAroundStalledURL(t *testing.T) {
+	server := newTestServer(t)
+	server.slackWorkers = 2
+
+	stalledURL := "https://hooks.slack.com/commands/T0001/1/stalled"
+	slack := &stallingSlack{
+		stalledURL: stalledURL,
+		release:    make(chan interface{}),
+		delivered:  make(map[string]int),
+	}
+	oldTransport := http.DefaultTransport
+	http.DefaultTransport = slack
+	oldOut := log.StandardLogger().Out
+	log.SetOutput(ioutil.Discard)
+	defer func() {
+		http.DefaultTransport = oldTransport
+		log.SetOutput(oldOut)
+	}()
+
+	workersDone := make(chan interface{})
+	go func() {
+		server.runSlackWorkers()
+		close(workersDone)
+	}()
+
+	// plenty of messages for the stalled URL, queued ahead of everyone else's
+	messages := []SlackMessage{}
+	for i := 0; i < 2000; i++ {
+		messages = append(messages, SlackMessage{url: stalledURL, message: "stalled", queuedAt: time.Now(), logFields: log.Fields{}})
+	}
+	otherURLs := []string{}
+	for i := 0; i < 10; i++ {
+		otherURL := fmt.Sprintf("https://hooks.slack.com/commands/T0001/%d/other", i+2)
+		otherURLs = append(otherURLs, otherURL)
+		messages = append(messages, SlackMessage{url: otherURL, message: "other", queuedAt: time.Now(), logFields: log.Fields{}})
+	}
+	go server.queueSlackMessages(messages)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, otherURL := range otherURLs {
+		for slack.deliveredTo(otherURL) == 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("nothing was delivered to %s while another URL was stalled", otherURL)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if delivered := slack.deliveredTo(stalledURL); delivered != 0 {
+		t.Errorf("%d messages were delivered to the stalled URL", delivered)
+	}
+
+	// once it's released, the stalled URL's messages all go out, and the workers stop
+	close(slack.release)
+	server.waitGroup.Wait()
+	close(server.outChan)
+	select {
+	case <-workersDone:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("workers didn't stop")
+	}
+	if delivered := slack.deliveredTo(stalledURL); delivered != 2000 {
+		t.Errorf("got %d messages delivered to the stalled URL, expected 2000", delivered)
+	}
+}
+
+func TestSlackWorkersParkRateLimitedMessages(t *testing.T) {
+	server := newTestServer(t)
+	server.slackWorkers = 1
+
+	rateLimitedURL := "https://hooks.slack.com/commands/T0001/1/ratelimited"
+	otherURL := "https://hooks.slack.com/commands/T0001/2/other"
+	slack := &stallingSlack{
+		rateLimitedURL: rateLimitedURL,
+		delivered:      make(map[string]int),
+	}
+	oldTransport := http.DefaultTransport
+	http.DefaultTransport = slack
+	oldOut := log.StandardLogger().Out
+	log.SetOutput(ioutil.Discard)
+	defer func() {
+		http.DefaultTransport = oldTransport
+		log.SetOutput(oldOut)
+	}()
+
+	workersDone := make(chan interface{})
+	go func() {
+		server.runSlackWorkers()
+		close(workersDone)
+	}()
+
+	// the only worker isn't kept waiting for Retry-After, so the other message goes out first
+	start := time.Now()
+	server.queueSlackMessages([]SlackMessage{
+		{url: rateLimitedURL, message: "first", queuedAt: time.Now(), logFields: log.Fields{}},
+		{url: otherURL, message: "second", queuedAt: time.Now(), logFields: log.Fields{}},
+	})
+	server.waitGroup.Wait()
+	close(server.outChan)
+	<-workersDone
+
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("rate limited message was retried after %s, before Retry-After", elapsed)
+	}
+	expected := []string{otherURL, rateLimitedURL}
+	if len(slack.order) != len(expected) || slack.order[0] != expected[0] || slack.order[1] != expected[1] {
+		t.Errorf("got deliveries %v, expected %v", slack.order, expected)
+	}
+}
@@ -9,7 +9,9 @@ type SlackTextMessage struct {
 
 // SlackTextAttachment defines the structure for attaching text to Slack messages
 type SlackTextAttachment struct {
-	Text string `json:"text"`
+	Text     string `json:"text,omitempty"`
+	Fallback string `json:"fallback,omitempty"`
+	ImageURL string `json:"image_url,omitempty"`
 }
 
 // SlackOAuthResponse defines the structure of a response from Slack after an OAuth handshake
@@ -35,3 +37,20 @@ type SlackOAuthResponse struct {
 		Warning     string `json:"warning"`
 	} `json:"bot"`
 }
+
+// SlackEventCallback defines the structure of a request from the Slack Events API
+type SlackEventCallback struct {
+	Token     string `json:"token"`
+	Type      string `json:"type"`      // "url_verification" or "event_callback"
+	Challenge string `json:"challenge"` // only for url_verification
+	TeamID    string `json:"team_id"`
+	EventID   string `json:"event_id"`
+
+	Event struct {
+		Type   string `json:"type"`
+		Tokens struct {
+			OAuth []string `json:"oauth"` // IDs of users whose tokens were revoked
+			Bot   []string `json:"bot"`   // IDs of bot users whose tokens were revoked
+		} `json:"tokens"` // only for tokens_revoked
+	} `json:"event"`
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// signed Slack requests older than this are rejected, so they can't be replayed
+const slackRequestMaxAge = 5 * time.Minute
+
+// largest Slack request body we'll read
+const maxSlackRequestBytes = 1 << 20
+
+// verifySlackRequest wraps a handler so it only sees requests that really came from Slack. Requests are
+// checked against their signature if we have a signing secret, otherwise against the legacy verification token.
+func (s *Server) verifySlackRequest(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logFields := log.Fields{
+			"area":    "verify",
+			"request": r.URL.Path,
+			"remote":  r.RemoteAddr,
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSlackRequestBytes))
+		if err != nil {
+			log.WithFields(logFields).Errorf("Error reading request body: %s", err)
+			http.Error(w, "error", http.StatusBadRequest)
+			return
+		}
+		// let the handler read the body too
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		if s.signingSecret != "" {
+			err = verifySlackSignature(s.signingSecret, r.Header, body, time.Now())
+		} else {
+			err = verifySlackToken(s.verificationToken, r.Header.Get("Content-Type"), body)
+		}
+		if err != nil {
+			log.WithFields(logFields).Warnf("Rejected unverified Slack request: %s", err)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// verifySlackSignature checks the X-Slack-Signature header, which is an HMAC of the timestamp and body
+func verifySlackSignature(signingSecret string, header http.Header, body []byte, now time.Time) error {
+	timestampStr := header.Get("X-Slack-Request-Timestamp")
+	signature := header.Get("X-Slack-Signature")
+	if timestampStr == "" || signature == "" {
+		return fmt.Errorf("Missing signature headers")
+	}
+
+	timestamp, err := strconv.ParseInt(timestampStr, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid timestamp: %s", timestampStr)
+	}
+	age := now.Sub(time.Unix(timestamp, 0))
+	if age > slackRequestMaxAge || age < -slackRequestMaxAge {
+		return fmt.Errorf("Timestamp is outside of the replay window: %s", timestampStr)
+	}
+
+	mac := hmac.New(sha256.New, []byte(signingSecret))
+	mac.Write([]byte("v0:" + timestampStr + ":"))
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return fmt.Errorf("Signature mismatch")
+	}
+	return nil
+}
+
+// verifySlackToken checks the legacy verification token, sent in the form or JSON body
+func verifySlackToken(verificationToken string, contentType string, body []byte) error {
+	if verificationToken == "" {
+		return fmt.Errorf("No signing secret or verification token configured")
+	}
+
+	var token string
+	if strings.HasPrefix(contentType, "application/json") {
+		tokenBody := struct {
+			Token string `json:"token"`
+		}{}
+		if err := json.Unmarshal(body, &tokenBody); err != nil {
+			return fmt.Errorf("Error unmarshalling body: %s", err)
+		}
+		token = tokenBody.Token
+	} else {
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return fmt.Errorf("Error parsing form: %s", err)
+		}
+		token = form.Get("token")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(token), []byte(verificationToken)) != 1 {
+		return fmt.Errorf("Verification token mismatch")
+	}
+	return nil
+}
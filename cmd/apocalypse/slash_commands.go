@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"strings"
+)
+
+// reply to commands that need the bot installed in the channel
+const notInstalledReply = "The Apocalypse Trump bot isn't installed in this channel yet."
+
+// slashRequest is a parsed /trump request
+type slashRequest struct {
+	teamID      string
+	channelID   string
+	userName    string
+	args        []string // words after the subcommand
+	responseURL string
+	logFields   log.Fields
+}
+
+// accountKey returns the key of the account installed in the channel the command was run in
+func (req *slashRequest) accountKey() string {
+	return accountKey(req.teamID, req.channelID)
+}
+
+// slashResponse is a subcommand's reply
+type slashResponse struct {
+	text      string
+	quip      string // optional quote to attach
+	inChannel bool   // show the reply to the whole channel, instead of just the user who asked
+	delayed   bool   // acknowledge right away, then send the reply to the response_url, so the command shows above it
+}
+
+// slashCommand is a /trump subcommand
+type slashCommand struct {
+	name    string
+	usage   string // arguments, ex: "[1d|7d|30d|all]"
+	help    string // one-line description
+	handler func(s *Server, req *slashRequest) slashResponse
+}
+
+// slashCommands returns every /trump subcommand, in the order they're listed in help.
+// Running /trump without a subcommand runs the first one.
+func slashCommands() []*slashCommand {
+	return []*slashCommand{
+		{
+			name:    "now",
+			help:    "Show the latest forecast, with a quote",
+			handler: (*Server).nowSlashCommand,
+		},
+		{
+			name:  "history",
+			usage: "[1d|7d|30d|all]",
+			help:  "Show how the forecast has moved",
+			handler: func(s *Server, req *slashRequest) slashResponse {
+				return slashResponse{text: s.historyCommand(req.accountKey(), req.args), inChannel: true}
+			},
+		},
+		{
+			name: "quote",
+			help: "Share a Donald Trump quote",
+			handler: func(s *Server, req *slashRequest) slashResponse {
+				return slashResponse{text: randomQuip(), inChannel: true}
+			},
+		},
+		{
+			name:  "models",
+			usage: "[<model> ...|default]",
+			help:  "Show or choose the forecast models this channel follows",
+			handler: func(s *Server, req *slashRequest) slashResponse {
+				return slashResponse{text: s.modelsCommand(req.accountKey(), req.args)}
+			},
+		},
+		{
+			name:  "watch",
+			usage: "[<state> ...]",
+			help:  "Get alerts when states move, ex: `/trump watch PA FL OH`",
+			handler: func(s *Server, req *slashRequest) slashResponse {
+				return slashResponse{text: s.watchCommand(req.accountKey(), req.args)}
+			},
+		},
+		{
+			name:  "unwatch",
+			usage: "<state> [<state> ...]",
+			help:  "Stop getting alerts for states",
+			handler: func(s *Server, req *slashRequest) slashResponse {
+				return slashResponse{text: s.unwatchCommand(req.accountKey(), req.args)}
+			},
+		},
+		{
+			name: "subscribe",
+			help: "Resume notifications in this channel",
+			handler: func(s *Server, req *slashRequest) slashResponse {
+				return slashResponse{text: s.setSubscribed(req.accountKey(), true)}
+			},
+		},
+		{
+			name: "unsubscribe",
+			help: "Pause notifications in this channel - /trump still works",
+			handler: func(s *Server, req *slashRequest) slashResponse {
+				return slashResponse{text: s.setSubscribed(req.accountKey(), false)}
+			},
+		},
+		{
+			name:    "settings",
+			help:    "Show this channel's settings",
+			handler: (*Server).settingsSlashCommand,
+		},
+		{
+			name:    "help",
+			usage:   "[<command>]",
+			help:    "Show this help",
+			handler: (*Server).helpSlashCommand,
+		},
+	}
+}
+
+// findSlashCommand looks up a subcommand by name
+func findSlashCommand(name string) (*slashCommand, bool) {
+	for _, command := range slashCommands() {
+		if command.name == strings.ToLower(name) {
+			return command, true
+		}
+	}
+	return nil, false
+}
+
+// dispatchSlashCommand runs the subcommand named by the first word of the text
+func (s *Server) dispatchSlashCommand(text string, req *slashRequest) slashResponse {
+	args := strings.Fields(text)
+	if len(args) == 0 {
+		return slashCommands()[0].handler(s, req)
+	}
+
+	command, ok := findSlashCommand(args[0])
+	if !ok {
+		log.WithFields(req.logFields).Infof("Unknown /trump subcommand")
+		return slashResponse{text: fmt.Sprintf("Unknown command: `%s`. Try `/trump help`", args[0])}
+	}
+	req.args = args[1:]
+	return command.handler(s, req)
+}
+
+// show the latest forecast for the team's models and states
+func (s *Server) nowSlashCommand(req *slashRequest) slashResponse {
+	s.mutex.Lock()
+	account := s.serverState.Tokens[req.accountKey()]
+	series := s.accountSeries(account)
+	lines := []string{}
+	for _, key := range series {
+		if forecast, modelForecast, ok := s.latestModel(key); ok {
+			label := seriesLabel(key, len(series))
+			lines = append(lines, chanceLine(label, modelForecast.TrumpChance, 0, forecast.URL))
+			lines = append(lines, projectionLines(key, label, modelForecast, nil)...)
+		}
+	}
+	if account != nil {
+		for _, key := range series {
+			for _, state := range account.WatchedStates {
+				if forecast, chance, ok := s.latestStateChance(key, state); ok {
+					lines = append(lines, stateChanceLine(state, seriesLabel(key, len(series)), chance, 0, forecast.URL))
+				}
+			}
+		}
+	}
+	s.mutex.Unlock()
+	if len(lines) == 0 {
+		lines = append(lines, "Chance of a Trump apocalypse: unknown - no forecast has been fetched yet")
+	}
+
+	return slashResponse{
+		text:      strings.Join(lines, "\n"),
+		quip:      randomQuip(),
+		inChannel: true,
+		delayed:   true,
+	}
+}
+
+// show everything the channel has configured
+func (s *Server) settingsSlashCommand(req *slashRequest) slashResponse {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	account, ok := s.serverState.Tokens[req.accountKey()]
+	if !ok {
+		return slashResponse{text: notInstalledReply}
+	}
+
+	notifications := "on"
+	if account.Disabled {
+		notifications = fmt.Sprintf("disabled on %s, because Slack said \"%s\" - reinstall the bot to turn them back on",
+			account.DisabledAt.Format("Jan 2 15:04 MST"), account.DisabledReason)
+	} else if account.Unsubscribed {
+		notifications = "paused - resume with `/trump subscribe`"
+	}
+	states := "none"
+	if len(account.WatchedStates) > 0 {
+		states = strings.Join(account.WatchedStates, ", ")
+	}
+	return slashResponse{text: fmt.Sprintf("Notifications: %s\nModels: %s\nWatched states: %s",
+		notifications, strings.Join(s.accountSeries(account), ", "), states)}
+}
+
+// list every subcommand, or explain one
+func (s *Server) helpSlashCommand(req *slashRequest) slashResponse {
+	commands := slashCommands()
+	if len(req.args) > 0 {
+		command, ok := findSlashCommand(req.args[0])
+		if !ok {
+			return slashResponse{text: fmt.Sprintf("Unknown command: `%s`. Try `/trump help`", req.args[0])}
+		}
+		commands = []*slashCommand{command}
+	}
+
+	lines := []string{}
+	for _, command := range commands {
+		usage := strings.TrimSpace(fmt.Sprintf("/trump %s %s", command.name, command.usage))
+		lines = append(lines, fmt.Sprintf("`%s` - %s", usage, command.help))
+	}
+	return slashResponse{text: strings.Join(lines, "\n")}
+}
+
+// pause or resume a channel's notifications. Returns the text to reply with.
+func (s *Server) setSubscribed(key string, subscribed bool) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	account, ok := s.serverState.Tokens[key]
+	if !ok {
+		return notInstalledReply
+	}
+
+	account.Unsubscribed = !subscribed
+	if err := s.saveServerData(); err != nil {
+		log.WithFields(log.Fields{
+			"area":    "db",
+			"account": key,
+		}).Errorf("Error saving subscription: %s", err)
+		return "Sorry, your change couldn't be saved. Please try again later."
+	}
+
+	if subscribed {
+		return "This channel will be notified when the forecast changes."
+	}
+	return "Notifications are paused for this channel. Resume them with `/trump subscribe`"
+}
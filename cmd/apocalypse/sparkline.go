@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// sparkline bars, lowest to highest
+	_sparkBars = []rune("▁▂▃▄▅▆▇█")
+)
+
+// number of bars in a /trump history sparkline
+const sparklineWidth = 24
+
+// historyCommand handles "/trump history [1d|7d|30d|all]", which shows how the channel's
+// models have moved over the window. Returns the text to reply with.
+func (s *Server) historyCommand(key string, args []string) string {
+	window := "7d"
+	if len(args) > 0 {
+		window = args[0]
+	}
+	duration, err := parseWindow(window)
+	if err != nil {
+		return fmt.Sprintf("%s. Usage: `/trump history [1d|7d|30d|all]`", err)
+	}
+
+	s.mutex.Lock()
+	series := s.accountSeries(s.serverState.Tokens[key])
+	s.mutex.Unlock()
+
+	now := time.Now()
+	since := time.Time{}
+	if duration > 0 {
+		since = now.Add(-duration)
+	}
+
+	lines := []string{}
+	for _, key := range series {
+		source, model := splitSeriesKey(key)
+		points := s.history.Query(source, model, metricWinProb, since)
+		if len(points) == 0 {
+			lines = append(lines, fmt.Sprintf("Chance of a Trump apocalypse%s: no history yet", labelStr(seriesLabel(key, len(series)))))
+			continue
+		}
+
+		start := since
+		if start.Before(points[0].Time) {
+			start = points[0].Time
+		}
+		// the first point is the value in effect at the start of the window
+		min, max := points[0].Value, points[0].Value
+		for _, point := range points {
+			if point.Value < min {
+				min = point.Value
+			}
+			if point.Value > max {
+				max = point.Value
+			}
+		}
+		current := points[len(points)-1].Value
+		values := resampleHistory(points, start, now, sparklineWidth)
+
+		lines = append(lines, fmt.Sprintf("Chance of a Trump apocalypse%s, last %s:\n%s  now %.1f%%, min %.1f%%, max %.1f%%, change %+.1f%%",
+			labelStr(seriesLabel(key, len(series))), window, sparkline(values), current, min, max, current-points[0].Value))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// resampleHistory turns points into evenly-spaced values between start and end. Each value is
+// the series' value at the end of its bucket. Points must be sorted, and the first must be at or before start.
+func resampleHistory(points []HistoryPoint, start time.Time, end time.Time, buckets int) []float32 {
+	values := make([]float32, buckets)
+	step := end.Sub(start) / time.Duration(buckets)
+	i := 0
+	for bucket := 0; bucket < buckets; bucket++ {
+		bucketEnd := start.Add(step * time.Duration(bucket+1))
+		for i+1 < len(points) && !points[i+1].Time.After(bucketEnd) {
+			i++
+		}
+		values[bucket] = points[i].Value
+	}
+	return values
+}
+
+// sparkline draws the values as a string of bars, scaled between their min and max
+func sparkline(values []float32) string {
+	if len(values) == 0 {
+		return ""
+	}
+	min, max := values[0], values[0]
+	for _, value := range values {
+		if value < min {
+			min = value
+		}
+		if value > max {
+			max = value
+		}
+	}
+
+	bars := make([]rune, len(values))
+	for i, value := range values {
+		level := len(_sparkBars) / 2
+		if max > min {
+			level = int((value - min) / (max - min) * float32(len(_sparkBars)-1))
+		}
+		bars[i] = _sparkBars[level]
+	}
+	return string(bars)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+var (
+	// states, DC, and the congressional districts of Maine and Nebraska, which award their own electoral votes
+	_states = map[string]string{
+		"AL": "Alabama", "AK": "Alaska", "AZ": "Arizona", "AR": "Arkansas", "CA": "California",
+		"CO": "Colorado", "CT": "Connecticut", "DE": "Delaware", "DC": "District of Columbia", "FL": "Florida",
+		"GA": "Georgia", "HI": "Hawaii", "ID": "Idaho", "IL": "Illinois", "IN": "Indiana",
+		"IA": "Iowa", "KS": "Kansas", "KY": "Kentucky", "LA": "Louisiana", "ME": "Maine",
+		"MD": "Maryland", "MA": "Massachusetts", "MI": "Michigan", "MN": "Minnesota", "MS": "Mississippi",
+		"MO": "Missouri", "MT": "Montana", "NE": "Nebraska", "NV": "Nevada", "NH": "New Hampshire",
+		"NJ": "New Jersey", "NM": "New Mexico", "NY": "New York", "NC": "North Carolina", "ND": "North Dakota",
+		"OH": "Ohio", "OK": "Oklahoma", "OR": "Oregon", "PA": "Pennsylvania", "RI": "Rhode Island",
+		"SC": "South Carolina", "SD": "South Dakota", "TN": "Tennessee", "TX": "Texas", "UT": "Utah",
+		"VT": "Vermont", "VA": "Virginia", "WA": "Washington", "WV": "West Virginia", "WI": "Wisconsin",
+		"WY":  "Wyoming",
+		"ME1": "Maine's 1st District", "ME2": "Maine's 2nd District",
+		"NE1": "Nebraska's 1st District", "NE2": "Nebraska's 2nd District", "NE3": "Nebraska's 3rd District",
+	}
+)
+
+// normalizeState returns the canonical code for a state, and whether it's a state we know about
+func normalizeState(code string) (string, bool) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	_, ok := _states[code]
+	return code, ok
+}
+
+// sortedStates returns a sorted copy of the state codes
+func sortedStates(codes []string) []string {
+	sorted := append([]string{}, codes...)
+	sort.Strings(sorted)
+	return sorted
+}
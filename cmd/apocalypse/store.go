@@ -0,0 +1,26 @@
+package main
+
+// Store is where the server state is kept between runs
+type Store interface {
+	// Load returns the stored state, or an empty state if nothing's been stored yet. If there's stored
+	// state that can't be read, it fails rather than returning an empty state, so accounts aren't lost.
+	Load() (*ServerState, error)
+
+	// Save replaces the stored state. Either all of the new state is stored, or none of it is.
+	Save(serverState *ServerState) error
+}
+
+// HistoryStore is where forecast history is kept
+type HistoryStore interface {
+	// Load returns every stored point
+	Load() ([]HistoryPoint, error)
+
+	// Append stores new points
+	Append(points []HistoryPoint) error
+
+	// Replace replaces every stored point, after compaction
+	Replace(points []HistoryPoint) error
+
+	// Close releases the store
+	Close() error
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"strings"
+)
+
+// latestStateChance returns the most recently-fetched chance of a state for a series - lock should already be held
+func (s *Server) latestStateChance(key string, state string) (*Forecast, float32, bool) {
+	forecast, modelForecast, ok := s.latestModel(key)
+	if !ok {
+		return nil, 0, false
+	}
+	chance, ok := modelForecast.States[state]
+	return forecast, chance, ok
+}
+
+// watchedStateChanges returns a message line for each of the team's watched states that changed
+// since they were last reported, along with the values to record as reported - lock should already be held
+func (s *Server) watchedStateChanges(team *Account, series []string, fetchedSeries map[string]bool) ([]string, map[string]float32) {
+	lines := []string{}
+	reported := make(map[string]float32)
+	for _, key := range series {
+		if !fetchedSeries[key] {
+			continue
+		}
+		for _, state := range team.WatchedStates {
+			forecast, chance, ok := s.latestStateChance(key, state)
+			if !ok {
+				continue
+			}
+			stateKey := stateSeriesKey(key, state)
+			previous := team.ReportedStates[stateKey]
+			if previous == chance {
+				continue
+			}
+			lines = append(lines, stateChanceLine(state, seriesLabel(key, len(series)), chance, previous, forecast.URL))
+			reported[stateKey] = chance
+		}
+	}
+	return lines, reported
+}
+
+// watchCommand handles "/trump watch [state ...]", which adds states the channel is alerted
+// about, or lists them. Returns the text to reply with.
+func (s *Server) watchCommand(key string, args []string) string {
+	return s.updateWatchedStates(key, args, true)
+}
+
+// unwatchCommand handles "/trump unwatch <state> [state ...]". Returns the text to reply with.
+func (s *Server) unwatchCommand(key string, args []string) string {
+	if len(args) == 0 {
+		return "Usage: `/trump unwatch <state> [<state> ...]`, ex: `/trump unwatch PA FL`"
+	}
+	return s.updateWatchedStates(key, args, false)
+}
+
+// add or remove watched states
+func (s *Server) updateWatchedStates(key string, args []string, watch bool) string {
+	states := []string{}
+	for _, arg := range args {
+		state, ok := normalizeState(arg)
+		if !ok {
+			return fmt.Sprintf("Unknown state: %s. Use two-letter state codes, ex: `/trump watch PA FL OH`", arg)
+		}
+		states = append(states, state)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	account, ok := s.serverState.Tokens[key]
+	if !ok {
+		return notInstalledReply
+	}
+
+	if len(states) > 0 {
+		watched := make(map[string]bool)
+		for _, state := range account.WatchedStates {
+			watched[state] = true
+		}
+		for _, state := range states {
+			watched[state] = watch
+		}
+		account.WatchedStates = []string{}
+		for state, ok := range watched {
+			if ok {
+				account.WatchedStates = append(account.WatchedStates, state)
+			}
+		}
+		account.WatchedStates = sortedStates(account.WatchedStates)
+
+		if err := s.saveServerData(); err != nil {
+			log.WithFields(log.Fields{
+				"area":    "db",
+				"account": key,
+			}).Errorf("Error saving watched states: %s", err)
+			return "Sorry, your states couldn't be saved. Please try again later."
+		}
+	}
+
+	if len(account.WatchedStates) == 0 {
+		return "This channel isn't watching any states. Add some with `/trump watch PA FL OH`"
+	}
+	return fmt.Sprintf("This channel gets alerts for: %s\nChange with `/trump watch <state> ...` and `/trump unwatch <state> ...`",
+		strings.Join(account.WatchedStates, ", "))
+}